@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/netcdf"
+	"github.com/visheratin/storage/storage"
+)
+
+var archiveTypes = map[string]string{
+	storage.TarFormat:   "application/x-tar",
+	storage.TarGzFormat: "application/gzip",
+	storage.ZipFormat:   "application/zip",
+}
+
+// catalogCriteria reads catalog filters from the query: variable and
+// dimension name files having them, attr=key or attr=key=value files with
+// a global attribute.
+func catalogCriteria(q url.Values) []netcdf.Criterion {
+	var cs []netcdf.Criterion
+	for _, v := range q["variable"] {
+		cs = append(cs, netcdf.Criterion{Type: netcdf.VAR, Key: v})
+	}
+	for _, d := range q["dimension"] {
+		cs = append(cs, netcdf.Criterion{Type: netcdf.DIM, Key: d})
+	}
+	for _, a := range q["attr"] {
+		kv := strings.SplitN(a, "=", 2)
+		c := netcdf.Criterion{Type: netcdf.ATTR, Key: kv[0]}
+		if len(kv) == 2 {
+			c.Value = kv[1]
+		}
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// archiveHandler streams every file under the prefix as a tar, tar.gz or
+// zip archive, selected with the format parameter.
+func archiveHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q := r.URL.Query()
+	prefix := strings.Trim(ps.ByName("path"), "/")
+	format := q.Get("format")
+	if format == "" {
+		format = storage.TarFormat
+	}
+	ct, ok := archiveTypes[format]
+	if !ok {
+		http.Error(w, "Unknown archive format: "+format, http.StatusBadRequest)
+		return
+	}
+
+	var include func(file.Info) bool
+	if cs := catalogCriteria(q); len(cs) > 0 {
+		paths, err := netcdf.MatchingPaths(db, cs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		include = func(info file.Info) bool {
+			return paths[info.Path]
+		}
+	}
+
+	name := path.Base(prefix)
+	if prefix == "" {
+		name = "files"
+	}
+	h := w.Header()
+	h.Set("Content-Type", ct)
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	pw := &pendingWriter{w: w}
+	err := s.Archive(pw, format, prefix, include)
+	if err != nil {
+		if !pw.written {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		log.Printf("Archive of %s failed: %v", prefix, err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/visheratin/storage/file"
+)
+
+var errInvalidDigest = errors.New("Invalid digest header")
+
+// requestDigest returns the hex encoded SHA-256 the client sent in a
+// Content-Digest (RFC 9530) or Digest (RFC 3230) header, or an empty
+// string when there is none.
+func requestDigest(r *http.Request) (string, error) {
+	if h := r.Header.Get("Content-Digest"); h != "" {
+		sum, err := structuredDigest(h)
+		if sum != "" || err != nil {
+			return sum, err
+		}
+	}
+	if h := r.Header.Get("Digest"); h != "" {
+		for _, d := range strings.Split(h, ",") {
+			kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "sha-256") {
+				return decodeDigest(kv[1])
+			}
+		}
+	}
+	return "", nil
+}
+
+// reprDigest returns the hex encoded SHA-256 from a Repr-Digest header,
+// which describes the whole file rather than the request body.
+func reprDigest(r *http.Request) (string, error) {
+	if h := r.Header.Get("Repr-Digest"); h != "" {
+		return structuredDigest(h)
+	}
+	return "", nil
+}
+
+// structuredDigest parses an RFC 9530 digest field value.
+func structuredDigest(h string) (string, error) {
+	for _, d := range strings.Split(h, ",") {
+		kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "sha-256") {
+			return decodeDigest(strings.Trim(kv[1], ":"))
+		}
+	}
+	return "", nil
+}
+
+func decodeDigest(v string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(b) != 32 {
+		return "", errInvalidDigest
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// setDigestHeaders announces the recorded checksums of a file.
+func setDigestHeaders(h http.Header, info file.Info) {
+	sha, err := hex.DecodeString(info.Checksum)
+	if err != nil || len(sha) == 0 {
+		return
+	}
+	b64 := base64.StdEncoding.EncodeToString(sha)
+	h.Set("Repr-Digest", "sha-256=:"+b64+":")
+	digest := "sha-256=" + b64
+	if crc, err := hex.DecodeString(info.CRC32C); err == nil && len(crc) > 0 {
+		digest += ",crc32c=" + base64.StdEncoding.EncodeToString(crc)
+	}
+	h.Set("Digest", digest)
+}
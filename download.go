@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/storage"
+)
+
+var errUnsatisfiableRange = errors.New("Requested range not satisfiable")
+
+// parseRange parses a Range header against a file of the given size. Only
+// single byte ranges are supported, ok is false for headers that should be
+// ignored and the whole file served instead.
+func parseRange(h string, size int64) (offset, length int64, ok bool, err error) {
+	if !strings.HasPrefix(h, "bytes=") {
+		return 0, 0, false, nil
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(h, "bytes="))
+	if strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, false, nil
+	}
+	start, end := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if start == "" {
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errUnsatisfiableRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	}
+	offset, err = strconv.ParseInt(start, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, false, nil
+	}
+	if offset >= size {
+		return 0, 0, false, errUnsatisfiableRange
+	}
+	last := size - 1
+	if end != "" {
+		last, err = strconv.ParseInt(end, 10, 64)
+		if err != nil || last < offset {
+			return 0, 0, false, nil
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+	return offset, last - offset + 1, true, nil
+}
+
+// etagMatch reports whether etag is in the comma separated list h. Weak
+// comparison is used, as required for If-None-Match.
+func etagMatch(h, etag string) bool {
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modTime.After(t)
+	}
+	return false
+}
+
+// rangeApplies checks If-Range, the Range header is only honoured when the
+// client still has the current version of the file.
+func rangeApplies(r *http.Request, etag string, modTime time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) {
+		return ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && t.Equal(modTime)
+}
+
+// versionDownload serves a specific version of a file. Old versions are
+// immutable, so no conditional or range handling is needed for caching.
+func versionDownload(w http.ResponseWriter, path, version string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("ETag", `"`+version+`"`)
+	pw := &pendingWriter{w: w}
+	err := s.ReadVersion(path, version, pw)
+	if err != nil {
+		if !pw.written {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		log.Printf("Download of %s version %s failed: %v", path, version, err)
+	}
+}
+
+// pendingWriter records whether anything was written, so that errors
+// before the first byte can still be reported with a status code.
+type pendingWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (pw *pendingWriter) Write(p []byte) (int, error) {
+	pw.written = true
+	return pw.w.Write(p)
+}
+
+func downloadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	path := ps.ByName("path")
+	if v := r.URL.Query().Get("version"); v != "" {
+		versionDownload(w, path, v)
+		return
+	}
+	if r.URL.Query().Get("verify") != "" {
+		err := s.Verify(path)
+		if errors.Is(err, file.ErrChecksumMismatch) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+	}
+
+	// The headers are set from the same Stat the content is read under,
+	// so a concurrent upload cannot make them disagree.
+	sent := false
+	err := s.ReadWithInfo(path, func(info file.Info) (io.Writer, int64, int64, error) {
+		sent = true
+		etag := `"` + storage.ETag(info) + `"`
+		modTime := info.ModTime.UTC().Truncate(time.Second)
+		h := w.Header()
+		h.Set("ETag", etag)
+		h.Set("Last-Modified", modTime.Format(http.TimeFormat))
+		h.Set("Accept-Ranges", "bytes")
+		setDigestHeaders(h, info)
+
+		if notModified(r, etag, modTime) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil, 0, 0, nil
+		}
+
+		offset, length := int64(0), info.Size
+		status := http.StatusOK
+		if rh := r.Header.Get("Range"); rh != "" && rangeApplies(r, etag, modTime) {
+			o, l, ok, err := parseRange(rh, info.Size)
+			if err != nil {
+				h.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+				return nil, 0, 0, nil
+			}
+			if ok {
+				offset, length, status = o, l, http.StatusPartialContent
+				h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", o, o+l-1, info.Size))
+			}
+		}
+
+		h.Set("Content-Type", info.ContentType)
+		h.Set("Content-Length", strconv.FormatInt(length, 10))
+		w.WriteHeader(status)
+		if r.Method == http.MethodHead {
+			return nil, 0, 0, nil
+		}
+		return w, offset, length, nil
+	})
+	if err != nil {
+		if !sent {
+			http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+			return
+		}
+		// Headers are already sent, all we can do is cut the response.
+		log.Printf("Download of %s failed: %v", path, err)
+	}
+}
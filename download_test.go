@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header         string
+		offset, length int64
+		ok             bool
+		err            error
+	}{
+		{"bytes=0-9", 0, 10, true, nil},
+		{"bytes=10-", 10, 90, true, nil},
+		{"bytes=-10", 90, 10, true, nil},
+		{"bytes=-200", 0, 100, true, nil},
+		{"bytes=50-500", 50, 50, true, nil},
+		{"bytes=100-", 0, 0, false, errUnsatisfiableRange},
+		{"bytes=-0", 0, 0, false, errUnsatisfiableRange},
+		{"bytes=0-1,5-6", 0, 0, false, nil},
+		{"bytes=9-1", 0, 0, false, nil},
+		{"items=0-1", 0, 0, false, nil},
+		{"bytes=a-b", 0, 0, false, nil},
+	}
+	for _, c := range cases {
+		offset, length, ok, err := parseRange(c.header, 100)
+		if offset != c.offset || length != c.length || ok != c.ok || err != c.err {
+			t.Errorf("parseRange(%q) = %d, %d, %v, %v", c.header, offset, length, ok, err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Checksums of every stored file are kept in a sidecar file with this
+// prefix in the same directory.
+const metaPrefix = ".meta-"
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Meta is the content of a sidecar file. Size is the size of the content,
+// StoredSize and ModTime describe the data file on disk. A sidecar that does
+// not match the data file is stale and ignored, unless the data file is
+// compressed or encrypted: without the sidecar it could not be decoded.
+type Meta struct {
+	SHA256      string    `json:"sha256"`
+	CRC32C      string    `json:"crc32c,omitempty"`
+	Size        int64     `json:"size"`
+	StoredSize  int64     `json:"storedSize,omitempty"`
+	ModTime     time.Time `json:"modTime"`
+	Compression string    `json:"compression,omitempty"`
+	KeyID       string    `json:"keyId,omitempty"`
+	WrappedKey  string    `json:"wrappedKey,omitempty"`
+	// Shared marks a file that is a reference to a blob, its sidecar only
+	// holds the checksum and the rest is read from the blob's.
+	Shared bool `json:"shared,omitempty"`
+}
+
+// transformed reports whether the data file holds anything else than the
+// plain content.
+func (m Meta) transformed() bool {
+	return m.Compression != "" || m.KeyID != ""
+}
+
+func isMeta(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), metaPrefix)
+}
+
+func metaPath(fullPath string) string {
+	return filepath.Join(filepath.Dir(fullPath), metaPrefix+filepath.Base(fullPath))
+}
+
+// Digester computes the checksums of everything written to it.
+type Digester struct {
+	sha256 hash.Hash
+	crc32c hash.Hash32
+}
+
+func NewDigester() *Digester {
+	return &Digester{sha256.New(), crc32.New(crc32c)}
+}
+
+func (d *Digester) Write(p []byte) (int, error) {
+	d.sha256.Write(p)
+	d.crc32c.Write(p)
+	return len(p), nil
+}
+
+func (d *Digester) SHA256() string {
+	return hex.EncodeToString(d.sha256.Sum(nil))
+}
+
+func (d *Digester) CRC32C() string {
+	return hex.EncodeToString(d.crc32c.Sum(nil))
+}
+
+// VerifyingReader returns a reader that fails with ErrChecksumMismatch
+// instead of io.EOF when the content read from r does not have the
+// hex encoded SHA-256 checksum.
+func VerifyingReader(r io.Reader, checksum string) io.Reader {
+	return &verifyingReader{r, sha256.New(), checksum}
+}
+
+type verifyingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	checksum string
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	vr.h.Write(p[:n])
+	if err == io.EOF {
+		sum := hex.EncodeToString(vr.h.Sum(nil))
+		if sum != vr.checksum {
+			return n, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, vr.checksum, sum)
+		}
+	}
+	return n, err
+}
+
+func (fs *FileService) writeMeta(f *File, m Meta) error {
+	if m.Shared {
+		m = Meta{SHA256: m.SHA256, Shared: true}
+	}
+	return writeMetaFile(metaPath(fs.location(f.Path)), m)
+}
+
+func writeMetaFile(mp string, m Meta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(mp), tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), mp)
+}
+
+// readMeta returns the recorded checksums of f. A missing or stale sidecar
+// results in an empty Meta.
+func (fs *FileService) readMeta(f *File, fi os.FileInfo) (Meta, error) {
+	return fs.readMetaFile(metaPath(fs.location(f.Path)), fi)
+}
+
+func (fs *FileService) readMetaFile(mp string, fi os.FileInfo) (Meta, error) {
+	m, err := readMetaFile(mp, fi)
+	if err != nil || !m.Shared {
+		return m, err
+	}
+	// References are data files linked to the blob, so the blob's sidecar
+	// matches them as well.
+	m, err = readMetaFile(metaPath(fs.blobPath(m.SHA256)), fi)
+	if m.SHA256 != "" {
+		m.Shared = true
+	}
+	return m, err
+}
+
+func readMetaFile(mp string, fi os.FileInfo) (Meta, error) {
+	var m Meta
+	b, err := ioutil.ReadFile(mp)
+	if os.IsNotExist(err) {
+		return Meta{}, nil
+	}
+	if err != nil {
+		return Meta{}, err
+	}
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return Meta{}, err
+	}
+	if m.Shared || m.transformed() {
+		// Touching a compressed or encrypted file must not make it look
+		// plain, it is only ever replaced together with its sidecar.
+		return m, nil
+	}
+	stored := m.StoredSize
+	if stored == 0 {
+		// Sidecars written before compression support.
+		stored = m.Size
+	}
+	if stored != fi.Size() || !m.ModTime.Equal(fi.ModTime()) {
+		return Meta{}, nil
+	}
+	return m, nil
+}
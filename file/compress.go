@@ -0,0 +1,121 @@
+package file
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Compression selects which files FileService stores compressed. A file is
+// compressed when it is under one of Prefixes, or any prefix if there are
+// none, and has at least MinSize bytes. Files that do not get smaller are
+// stored as they are.
+type Compression struct {
+	Algorithm string
+	Prefixes  []string
+	MinSize   int64
+}
+
+func (c Compression) applies(path string, size int64) bool {
+	if c.Algorithm == "" || size < c.MinSize {
+		return false
+	}
+	if len(c.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range c.Prefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func compressor(algorithm string, w io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("Unknown compression algorithm: %s", algorithm)
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+func decompressor(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{d}, nil
+	}
+	return nil, fmt.Errorf("Unknown compression algorithm: %s", algorithm)
+}
+
+// compressFile writes a compressed copy of src next to it and returns the
+// name of the copy.
+func compressFile(src, algorithm string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(src), tempPrefix)
+	if err != nil {
+		return "", err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			out.Close()
+			os.Remove(out.Name())
+		}
+	}()
+	cw, err := compressor(algorithm, out)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(cw, in)
+	if err != nil {
+		return "", err
+	}
+	err = cw.Close()
+	if err != nil {
+		return "", err
+	}
+	err = out.Sync()
+	if err != nil {
+		return "", err
+	}
+	err = out.Close()
+	if err != nil {
+		return "", err
+	}
+	ok = true
+	return out.Name(), nil
+}
@@ -0,0 +1,131 @@
+package file
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Compression = Compression{Algorithm: Gzip, Prefixes: []string{"model/"}, MinSize: 100}
+
+	content := strings.Repeat("0123456789", 1000)
+	cases := map[string]bool{
+		"model/big.nc":   true,
+		"model/small.nc": false,
+		"obs/big.nc":     false,
+	}
+	for p, compressed := range cases {
+		f, err := fs.Resolve(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := content
+		if strings.Contains(p, "small") {
+			c = content[:50]
+		}
+		err = fs.Save(&f, strings.NewReader(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed != (f.FullPath == "") {
+			t.Errorf("%s: FullPath is %q after Save", p, f.FullPath)
+		}
+
+		info, err := fs.Stat(&f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len(c)) {
+			t.Errorf("%s: Stat returned size %d, want %d", p, info.Size, len(c))
+		}
+		if compressed && (info.Compression != Gzip || info.CompressionRatio < 5) {
+			t.Errorf("%s: Stat returned %+v", p, info)
+		}
+		if !compressed && info.Compression != "" {
+			t.Errorf("%s: uncompressed file reported as %s", p, info.Compression)
+		}
+
+		buf := new(bytes.Buffer)
+		err = fs.Read(&f, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != c {
+			t.Errorf("%s: Read returned wrong content", p)
+		}
+		buf.Reset()
+		err = fs.ReadRange(&f, buf, 15, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != c[15:25] {
+			t.Errorf("%s: ReadRange returned %q", p, buf.String())
+		}
+
+		r, err := fs.Resolve(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.FullPath != f.FullPath {
+			t.Errorf("%s: Resolve returned FullPath %q, Save set %q", p, r.FullPath, f.FullPath)
+		}
+	}
+}
+
+func TestCompressedFileTouched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Compression = Compression{Algorithm: Gzip}
+	f, err := fs.Resolve("big.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("0123456789", 1000)
+	err = fs.Save(&f, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(fs.location(f.Path), later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.Resolve("big.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FullPath != "" {
+		t.Errorf("touched compressed file resolved to %q", r.FullPath)
+	}
+	buf := new(bytes.Buffer)
+	err = fs.Read(&r, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != content {
+		t.Errorf("Read of touched compressed file returned %d bytes", buf.Len())
+	}
+}
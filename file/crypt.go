@@ -0,0 +1,289 @@
+package file
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Encrypted files are split into chunks of this many bytes which are sealed
+// separately, so that a range can be read without decrypting the whole file.
+const chunkSize = 64 << 10
+
+const (
+	keySize    = 32
+	sealedSize = chunkSize + 16
+)
+
+// Keyring holds the master keys data keys are wrapped with. Every file is
+// encrypted with its own data key, which is stored wrapped in the file's
+// sidecar together with the id of the master key.
+type Keyring struct {
+	keys   map[string][]byte
+	active string
+}
+
+// LoadKeyring reads a keyfile with one "<id> <hex encoded 32 byte key>"
+// pair per line. Empty lines and lines starting with # are ignored. The
+// last key in the file wraps the data keys of new files.
+func LoadKeyring(path string) (*Keyring, error) {
+	fl, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fl.Close()
+	kr := &Keyring{keys: make(map[string][]byte)}
+	sc := bufio.NewScanner(fl)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key id and key", path, n)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("%s:%d: key must be %d hex encoded bytes", path, n, keySize)
+		}
+		kr.keys[fields[0]] = key
+		kr.active = fields[0]
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if kr.active == "" {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return kr, nil
+}
+
+// Active returns the id of the key new data keys are wrapped with.
+func (kr *Keyring) Active() string {
+	return kr.active
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// wrap encrypts a data key with the active master key.
+func (kr *Keyring) wrap(dataKey []byte) (string, string, error) {
+	gcm, err := newGCM(kr.keys[kr.active])
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, dataKey, []byte(kr.active))
+	return kr.active, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (kr *Keyring) unwrap(id, wrapped string) ([]byte, error) {
+	key, ok := kr.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	b, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+	return gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], []byte(id))
+}
+
+// chunkNonce derives the nonce of a chunk from its index. The last chunk
+// uses a different nonce so that truncated files fail to decrypt.
+func chunkNonce(gcm cipher.AEAD, i int64, last bool) []byte {
+	nonce := make([]byte, gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(i))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptFile writes an encrypted copy of src next to it and returns the
+// name of the copy together with the wrapped data key.
+func (kr *Keyring) encryptFile(src string) (string, string, string, error) {
+	dataKey := make([]byte, keySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	id, wrapped, err := kr.wrap(dataKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(src), tempPrefix)
+	if err != nil {
+		return "", "", "", err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			out.Close()
+			os.Remove(out.Name())
+		}
+	}()
+	w := bufio.NewWriter(out)
+	buf := make([]byte, chunkSize)
+	next := make([]byte, chunkSize)
+	n, err := io.ReadFull(in, buf)
+	for i := int64(0); ; i++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", "", "", err
+		}
+		// A chunk is the last one when nothing follows it.
+		last := err != nil
+		var m int
+		if !last {
+			m, err = io.ReadFull(in, next)
+			last = m == 0 && err == io.EOF
+		}
+		_, werr := w.Write(gcm.Seal(nil, chunkNonce(gcm, i, last), buf[:n], nil))
+		if werr != nil {
+			return "", "", "", werr
+		}
+		if last {
+			break
+		}
+		buf, next, n = next, buf, m
+	}
+	err = w.Flush()
+	if err != nil {
+		return "", "", "", err
+	}
+	err = out.Sync()
+	if err != nil {
+		return "", "", "", err
+	}
+	err = out.Close()
+	if err != nil {
+		return "", "", "", err
+	}
+	ok = true
+	return out.Name(), id, wrapped, nil
+}
+
+// decrypter reads the plain content of an encrypted file starting with
+// chunk first.
+type decrypter struct {
+	r      io.Reader
+	gcm    cipher.AEAD
+	i      int64
+	chunks int64
+	buf    []byte
+	plain  []byte
+}
+
+func (kr *Keyring) decrypter(m Meta, r io.Reader, first int64) (*decrypter, error) {
+	dataKey, err := kr.unwrap(m.KeyID, m.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	chunks := (m.StoredSize + sealedSize - 1) / sealedSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return &decrypter{r: r, gcm: gcm, i: first, chunks: chunks, buf: make([]byte, sealedSize)}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.i >= d.chunks {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		d.plain, err = d.gcm.Open(d.buf[:0], chunkNonce(d.gcm, d.i, d.i == d.chunks-1), d.buf[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("decrypting chunk %d: %w", d.i, err)
+		}
+		d.i++
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (fs *FileService) decrypter(m Meta, r io.Reader, first int64) (io.Reader, error) {
+	if fs.Keys == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, m.KeyID)
+	}
+	return fs.Keys.decrypter(m, r, first)
+}
+
+// Rewrap wraps the data key of f with the active master key without
+// touching the content. It reports whether the sidecar had to change.
+func (fs *FileService) Rewrap(f *File) (bool, error) {
+	if fs.Keys == nil {
+		return false, nil
+	}
+	fi, err := os.Stat(fs.location(f.Path))
+	if err != nil {
+		return false, translate(f.Path, err)
+	}
+	m, err := fs.readMeta(f, fi)
+	if err != nil {
+		return false, err
+	}
+	if m.KeyID == "" || m.KeyID == fs.Keys.active {
+		return false, nil
+	}
+	dataKey, err := fs.Keys.unwrap(m.KeyID, m.WrappedKey)
+	if err != nil {
+		return false, err
+	}
+	m.KeyID, m.WrappedKey, err = fs.Keys.wrap(dataKey)
+	if err != nil {
+		return false, err
+	}
+	if m.Shared {
+		// Every reference shares the blob's sidecar.
+		return true, fs.writeBlobMeta(m)
+	}
+	return true, fs.writeMeta(f, m)
+}
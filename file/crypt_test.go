@@ -0,0 +1,241 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKeyfile(t *testing.T, dir string, lines ...string) string {
+	p := filepath.Join(dir, "keys")
+	err := ioutil.WriteFile(p, []byte(strings.Join(lines, "\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyDir, err := ioutil.TempDir("", "file-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+
+	kr, err := LoadKeyring(writeKeyfile(t, keyDir, "# embargo keys", "k1 "+strings.Repeat("11", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Keys = kr
+
+	sizes := []int{0, 10, chunkSize, chunkSize + 1, 3*chunkSize - 7}
+	for _, size := range sizes {
+		content := make([]byte, size)
+		rand.Read(content)
+		f, err := fs.Resolve("data.nc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.Save(&f, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.FullPath != "" {
+			t.Errorf("%d: encrypted file has FullPath %q", size, f.FullPath)
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(dir, "data.nc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 && bytes.Contains(raw, content) {
+			t.Errorf("%d: content stored in plain", size)
+		}
+
+		info, err := fs.Stat(&f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(size) || info.KeyID != "k1" {
+			t.Errorf("%d: Stat returned %+v", size, info)
+		}
+		buf := &bytes.Buffer{}
+		err = fs.Read(&f, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("%d: Read returned different content", size)
+		}
+		if size > chunkSize {
+			offset, length := int64(chunkSize-5), int64(chunkSize)
+			if offset+length > int64(size) {
+				length = int64(size) - offset
+			}
+			buf.Reset()
+			err = fs.ReadRange(&f, buf, offset, length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), content[offset:offset+length]) {
+				t.Errorf("%d: ReadRange returned different content", size)
+			}
+		}
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyDir, err := ioutil.TempDir("", "file-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+
+	old := "k1 " + strings.Repeat("11", 32)
+	kr, err := LoadKeyring(writeKeyfile(t, keyDir, old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Keys = kr
+	fs.Compression = Compression{Algorithm: Gzip}
+	content := strings.Repeat("embargoed ", 1000)
+	f, err := fs.Resolve("a/data.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Save(&f, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(filepath.Join(dir, "a", "data.nc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Keys, err = LoadKeyring(writeKeyfile(t, keyDir, old, "k2 "+strings.Repeat("22", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := fs.Rewrap(&f)
+	if err != nil || !changed {
+		t.Fatalf("Rewrap returned %v, %v", changed, err)
+	}
+	changed, err = fs.Rewrap(&f)
+	if err != nil || changed {
+		t.Fatalf("second Rewrap returned %v, %v", changed, err)
+	}
+	after, err := ioutil.ReadFile(filepath.Join(dir, "a", "data.nc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("Rewrap rewrote the content")
+	}
+
+	// The old key is no longer needed.
+	fs.Keys, err = LoadKeyring(writeKeyfile(t, keyDir, "k2 "+strings.Repeat("22", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat(&f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.KeyID != "k2" || info.Compression != Gzip {
+		t.Errorf("Stat returned %+v", info)
+	}
+	buf := &bytes.Buffer{}
+	err = fs.Read(&f, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != content {
+		t.Error("Read returned different content after Rewrap")
+	}
+
+	fs.Keys = nil
+	err = fs.Read(&f, buf)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Read without keys returned %v", err)
+	}
+}
+
+func TestTouchedEncryptedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyDir, err := ioutil.TempDir("", "file-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keyDir)
+
+	old := "k1 " + strings.Repeat("11", 32)
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Keys, err = LoadKeyring(writeKeyfile(t, keyDir, old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Resolve("data.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Save(&f, strings.NewReader("embargoed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(filepath.Join(dir, "data.nc"), later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Adopt(&f)
+	if err == nil {
+		t.Error("Adopt of an encrypted file succeeded")
+	}
+	fs.Keys, err = LoadKeyring(writeKeyfile(t, keyDir, old, "k2 "+strings.Repeat("22", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := fs.Rewrap(&f)
+	if err != nil || !changed {
+		t.Fatalf("Rewrap returned %v, %v", changed, err)
+	}
+	buf := &bytes.Buffer{}
+	err = fs.Read(&f, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "embargoed" {
+		t.Errorf("Read returned %q", buf.String())
+	}
+}
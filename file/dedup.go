@@ -0,0 +1,187 @@
+package file
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With deduplication the content of every saved file is kept once in this
+// directory, named by its SHA-256 checksum. Stored paths are hard links to
+// the blob and their sidecars refer to the blob's one, so a blob lives as
+// long as any path references it.
+const blobDir = ".blobs"
+
+func isBlob(path string) bool {
+	return path == blobDir || strings.HasPrefix(path, blobDir+"/")
+}
+
+func (fs *FileService) blobPath(sum string) string {
+	return filepath.Join(fs.Dir, blobDir, sum[:2], sum)
+}
+
+// sharedBlob returns the checksum of the blob f references, or an empty
+// string if f is not a reference.
+func (fs *FileService) sharedBlob(f *File) string {
+	b, err := ioutil.ReadFile(metaPath(fs.location(f.Path)))
+	if err != nil {
+		return ""
+	}
+	var m Meta
+	if json.Unmarshal(b, &m) != nil || !m.Shared {
+		return ""
+	}
+	return m.SHA256
+}
+
+// linkBlob creates a hard link to the blob with checksum sum at dst. It
+// reports false if there is no such blob.
+func (fs *FileService) linkBlob(sum, dst string) (Meta, bool, error) {
+	fs.blobs.Lock()
+	defer fs.blobs.Unlock()
+	return fs.linkExisting(sum, dst)
+}
+
+// linkExisting is linkBlob with fs.blobs held.
+func (fs *FileService) linkExisting(sum, dst string) (Meta, bool, error) {
+	blob := fs.blobPath(sum)
+	fi, err := os.Stat(blob)
+	if os.IsNotExist(err) {
+		return Meta{}, false, nil
+	}
+	if err != nil {
+		return Meta{}, false, err
+	}
+	m, err := readMetaFile(metaPath(blob), fi)
+	if err != nil || m.SHA256 != sum {
+		// Left behind by a crash, store replaces it.
+		return Meta{}, false, err
+	}
+	// Blobs stored before they were made read-only.
+	err = os.Chmod(blob, sharedMode)
+	if err != nil {
+		return Meta{}, false, err
+	}
+	err = os.Link(blob, dst)
+	if err != nil {
+		return Meta{}, false, err
+	}
+	m.Shared = true
+	return m, true, nil
+}
+
+// storeBlob makes the data file tmp with meta m the blob of its content.
+// If another save stored the same content in the meantime, that blob is
+// kept and linked to instead. It returns the data file to place and its
+// meta.
+func (fs *FileService) storeBlob(tmp string, m Meta) (string, Meta, error) {
+	fs.blobs.Lock()
+	defer fs.blobs.Unlock()
+	bm, ok, err := fs.linkExisting(m.SHA256, tmp+"-link")
+	if err != nil {
+		return "", Meta{}, err
+	}
+	if ok {
+		return tmp + "-link", bm, nil
+	}
+	blob := fs.blobPath(m.SHA256)
+	err = os.MkdirAll(filepath.Dir(blob), os.ModePerm)
+	if err != nil {
+		return "", Meta{}, err
+	}
+	// The sidecar goes first, a blob without a valid one is replaced.
+	m.Shared = false
+	err = writeMetaFile(metaPath(blob), m)
+	if err != nil {
+		return "", Meta{}, err
+	}
+	err = os.Remove(blob)
+	if err != nil && !os.IsNotExist(err) {
+		return "", Meta{}, err
+	}
+	err = os.Link(tmp, blob)
+	if err != nil {
+		return "", Meta{}, err
+	}
+	m.Shared = true
+	return tmp, m, nil
+}
+
+// split replaces f, a reference to the blob with checksum sum, with a plain
+// copy of the content read from r.
+func (fs *FileService) split(f *File, r io.Reader, sum string) error {
+	loc := fs.location(f.Path)
+	tmp, err := ioutil.TempFile(filepath.Dir(loc), tempPrefix+filepath.Base(loc)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	d := NewDigester()
+	size, err := io.Copy(io.MultiWriter(tmp, d), r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+	err = fs.place(f, tmp.Name(), Meta{
+		SHA256:     d.SHA256(),
+		CRC32C:     d.CRC32C(),
+		Size:       size,
+		StoredSize: fi.Size(),
+		ModTime:    fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	fs.release(sum)
+	return nil
+}
+
+// writeBlobMeta replaces the sidecar of a blob, used to rewrap its key.
+func (fs *FileService) writeBlobMeta(m Meta) error {
+	fs.blobs.Lock()
+	defer fs.blobs.Unlock()
+	m.Shared = false
+	return writeMetaFile(metaPath(fs.blobPath(m.SHA256)), m)
+}
+
+// release removes the blob with checksum sum once no path references it.
+func (fs *FileService) release(sum string) {
+	if sum == "" {
+		return
+	}
+	fs.blobs.Lock()
+	defer fs.blobs.Unlock()
+	blob := fs.blobPath(sum)
+	fi, err := os.Stat(blob)
+	if err != nil || links(fi) > 1 {
+		return
+	}
+	err = os.Remove(blob)
+	if err == nil {
+		err = os.Remove(metaPath(blob))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove unreferenced blob %s: %v", sum, err)
+	}
+}
@@ -0,0 +1,229 @@
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func blobCount(t *testing.T, dir string) int {
+	n := 0
+	filepath.Walk(filepath.Join(dir, blobDir), func(fp string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && !isMeta(fp) {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Dedup = true
+	fs.Compression = Compression{Algorithm: Gzip}
+	content := strings.Repeat("boundary conditions ", 100)
+
+	var files []File
+	for _, p := range []string{"a/bc.nc", "b/bc.nc", "c/bc.nc"} {
+		f, err := fs.Resolve(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.Save(&f, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	if n := blobCount(t, dir); n != 1 {
+		t.Fatalf("%d blobs for identical files", n)
+	}
+	info, err := fs.Stat(&files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.References != 3 || info.Size != int64(len(content)) || info.Compression != Gzip {
+		t.Errorf("info is %+v", info)
+	}
+
+	err = fs.Copy(&files[0], &File{Path: "d/bc.nc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Delete(&files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replacing content drops the reference as well.
+	err = fs.Save(&files[1], strings.NewReader("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := blobCount(t, dir); n != 2 {
+		t.Fatalf("%d blobs after replacing a file", n)
+	}
+	buf := &bytes.Buffer{}
+	err = fs.Read(&files[2], buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != content {
+		t.Error("shared content changed")
+	}
+
+	infos, err := fs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Errorf("List returned %d files, blobs included", len(infos))
+	}
+	for _, p := range []string{"c/bc.nc", "d/bc.nc", "b/bc.nc"} {
+		err = fs.Delete(&File{Path: p})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := blobCount(t, dir); n != 0 {
+		t.Errorf("%d blobs left without references", n)
+	}
+	_, err = fs.Resolve(".blobs/x")
+	if err == nil {
+		t.Error("blob directory resolved")
+	}
+}
+
+func TestConcurrentDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Dedup = true
+	const writers = 8
+	for round := 0; round < 20; round++ {
+		content := fmt.Sprintf("content of round %d", round)
+		var wg sync.WaitGroup
+		errs := make(chan error, writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				f, err := fs.Resolve(fmt.Sprintf("%d/%d.nc", round, i))
+				if err == nil {
+					err = fs.Save(&f, strings.NewReader(content))
+				}
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 0; i < writers; i++ {
+			f := File{Path: fmt.Sprintf("%d/%d.nc", round, i)}
+			info, err := fs.Stat(&f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Checksum == "" || info.References != writers {
+				t.Errorf("round %d: %s has %+v", round, f.Path, info)
+			}
+		}
+	}
+}
+
+func TestDedupWriteInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Dedup = true
+	var files []File
+	for _, p := range []string{"proj1/bc.nc", "proj2/bc.nc"} {
+		f, err := fs.Resolve(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.Save(&f, strings.NewReader("boundary conditions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	loc := filepath.Join(dir, "proj1", "bc.nc")
+	fi, err := os.Stat(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != sharedMode {
+		t.Errorf("shared file has mode %v", fi.Mode())
+	}
+
+	// Like root, which ignores the mode, writing in place.
+	os.Chmod(loc, 0644)
+	err = ioutil.WriteFile(loc, []byte("edited conditions"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat(&files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Checksum != "" {
+		t.Errorf("changed shared file has checksum %s", info.Checksum)
+	}
+	for _, f := range files {
+		info, err = fs.Adopt(&f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Checksum == "" || info.References != 0 {
+			t.Errorf("%s: Adopt returned %+v", f.Path, info)
+		}
+	}
+	if n := blobCount(t, dir); n != 0 {
+		t.Errorf("%d blobs left after splitting all references", n)
+	}
+	err = ioutil.WriteFile(loc, []byte("edited again"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = fs.Read(&files[1], buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "edited conditions" {
+		t.Errorf("write to a split file changed the other to %q", buf.String())
+	}
+}
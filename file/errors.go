@@ -0,0 +1,36 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var (
+	ErrNotFound    = errors.New("file not found")
+	ErrExists      = errors.New("file already exists")
+	ErrPermission  = errors.New("permission denied")
+	ErrInvalidPath = errors.New("invalid path")
+)
+
+// Is makes InvalidPathError match ErrInvalidPath with errors.Is.
+func (e *InvalidPathError) Is(target error) bool {
+	return target == ErrInvalidPath
+}
+
+// translate converts errors from the os package into the errors above so
+// callers do not depend on how a backend stores files.
+func translate(path string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ENOTDIR):
+		return fmt.Errorf("%s: %w", path, ErrNotFound)
+	case errors.Is(err, os.ErrExist), errors.Is(err, syscall.EISDIR):
+		return fmt.Errorf("%s: %w", path, ErrExists)
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Errorf("%s: %w", path, ErrPermission)
+	}
+	return err
+}
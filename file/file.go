@@ -1,9 +1,19 @@
 package file
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type File struct {
@@ -11,8 +21,53 @@ type File struct {
 	FullPath string
 }
 
+type Info struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+	Checksum    string    `json:"checksum,omitempty"`
+	CRC32C      string    `json:"crc32c,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	// StoredSize, Compression and CompressionRatio describe how the file
+	// is kept by backends that compress files.
+	StoredSize       int64   `json:"storedSize,omitempty"`
+	Compression      string  `json:"compression,omitempty"`
+	CompressionRatio float64 `json:"compressionRatio,omitempty"`
+	// KeyID is the master key the data key of an encrypted file is
+	// wrapped with.
+	KeyID string `json:"keyId,omitempty"`
+	// References is the number of paths sharing the content of a
+	// deduplicated file.
+	References int `json:"references,omitempty"`
+}
+
 type FileService struct {
-	Dir string
+	Dir         string
+	Compression Compression
+	// Keys enables encryption of saved files when set.
+	Keys *Keyring
+	// Dedup stores the content of saved files once per checksum.
+	Dedup bool
+	blobs sync.Mutex
+}
+
+// Uploads are written to a temporary file with this prefix next to the
+// final path and renamed into place once complete.
+const tempPrefix = ".upload-"
+
+func isTemp(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), tempPrefix)
+}
+
+// isReserved reports whether path names one of the files FileService keeps
+// for itself next to the stored files.
+func isReserved(path string) bool {
+	return isTemp(path) || isMeta(path) || isBlob(path)
+}
+
+// IsReserved reports whether a file named name is one of FileService's own.
+func IsReserved(name string) bool {
+	return isReserved(name)
 }
 
 func NewFileService(dir string) (*FileService, error) {
@@ -20,39 +75,720 @@ func NewFileService(dir string) (*FileService, error) {
 	if err != nil {
 		return nil, err
 	}
-	fs := &FileService{dir}
+	fs := &FileService{Dir: dir}
+	err = fs.cleanTemp()
+	if err != nil {
+		return nil, err
+	}
 	return fs, nil
 }
 
-func (fs *FileService) Resolve(path string) File {
-	fp := filepath.Join(fs.Dir, path)
-	return File{path, fp}
+// cleanTemp removes temporary files left behind by uploads that were
+// interrupted by a crash.
+func (fs *FileService) cleanTemp() error {
+	return filepath.Walk(fs.Dir, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !isTemp(fp) {
+			return nil
+		}
+		log.Printf("Removing orphaned temporary file %s", fp)
+		return os.Remove(fp)
+	})
+}
+
+func (fs *FileService) location(path string) string {
+	return filepath.Join(fs.Dir, filepath.FromSlash(path))
+}
+
+// Resolve leaves FullPath empty for compressed and encrypted files, they
+// have no plain copy on disk.
+func (fs *FileService) Resolve(path string) (File, error) {
+	p, err := Clean(path)
+	if err != nil {
+		return File{}, err
+	}
+	fp := fs.location(p)
+	ok, err := within(fs.Dir, fp)
+	if err != nil {
+		return File{}, translate(p, err)
+	}
+	if !ok {
+		return File{}, &InvalidPathError{path, "resolves outside of storage root"}
+	}
+	f := File{p, fp}
+	if fi, err := os.Stat(fp); err == nil && !fi.IsDir() {
+		m, err := fs.readMeta(&f, fi)
+		if err == nil && m.transformed() {
+			f.FullPath = ""
+		}
+	}
+	return f, nil
 }
 
 func (fs *FileService) Save(f *File, r io.Reader) error {
-	err := os.MkdirAll(filepath.Dir(f.FullPath), os.ModePerm)
+	old := fs.sharedBlob(f)
+	err := fs.save(f, r)
+	if err != nil {
+		return translate(f.Path, err)
+	}
+	fs.release(old)
+	return nil
+}
+
+func (fs *FileService) save(f *File, r io.Reader) error {
+	err := fs.prepare(f)
 	if err != nil {
 		return err
 	}
-	fl, err := os.Create(f.FullPath)
+	loc := fs.location(f.Path)
+	dir := filepath.Dir(loc)
+	fl, err := ioutil.TempFile(dir, tempPrefix+filepath.Base(loc)+"-")
 	if err != nil {
 		return err
 	}
-	defer fl.Close()
-	_, err = io.Copy(fl, r)
-	return err
+	tmp := fl.Name()
+	defer os.Remove(tmp)
+	d := NewDigester()
+	size, err := io.Copy(io.MultiWriter(fl, d), r)
+	if err != nil {
+		fl.Close()
+		return err
+	}
+	err = fl.Sync()
+	if err != nil {
+		fl.Close()
+		return err
+	}
+	err = fl.Close()
+	if err != nil {
+		return err
+	}
+
+	m := Meta{SHA256: d.SHA256(), CRC32C: d.CRC32C(), Size: size}
+	if fs.Dedup {
+		// The content is stored already, only link to it.
+		bm, ok, err := fs.linkBlob(m.SHA256, tmp+"-link")
+		if err != nil {
+			return err
+		}
+		if ok {
+			defer os.Remove(tmp + "-link")
+			return fs.place(f, tmp+"-link", bm)
+		}
+	}
+	if fs.Compression.applies(f.Path, size) {
+		ctmp, err := compressFile(tmp, fs.Compression.Algorithm)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(ctmp)
+		cfi, err := os.Stat(ctmp)
+		if err != nil {
+			return err
+		}
+		if cfi.Size() < size {
+			tmp = ctmp
+			m.Compression = fs.Compression.Algorithm
+		}
+	}
+
+	if fs.Keys != nil {
+		etmp, id, wrapped, err := fs.Keys.encryptFile(tmp)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(etmp)
+		tmp = etmp
+		m.KeyID, m.WrappedKey = id, wrapped
+	}
+
+	mode := os.FileMode(0644)
+	if fs.Dedup {
+		mode = sharedMode
+	}
+	err = os.Chmod(tmp, mode)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	m.StoredSize = fi.Size()
+	m.ModTime = fi.ModTime()
+	if fs.Dedup {
+		stored, bm, err := fs.storeBlob(tmp, m)
+		if err != nil {
+			return err
+		}
+		if stored != tmp {
+			defer os.Remove(stored)
+		}
+		tmp, m = stored, bm
+	}
+	return fs.place(f, tmp, m)
+}
+
+// place renames the data file tmp with meta m to the location of f.
+func (fs *FileService) place(f *File, tmp string, m Meta) error {
+	loc := fs.location(f.Path)
+	err := os.Rename(tmp, loc)
+	if err != nil {
+		return err
+	}
+	err = fs.writeMeta(f, m)
+	if err != nil {
+		return err
+	}
+	f.FullPath = loc
+	if m.transformed() {
+		f.FullPath = ""
+	}
+	return syncDir(filepath.Dir(loc))
+}
+
+// syncDir flushes a directory entry so that a rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// open returns a reader of the plain content of f starting at offset.
+func (fs *FileService) open(f *File, offset int64) (io.ReadCloser, error) {
+	fl, err := os.Open(fs.location(f.Path))
+	if err != nil {
+		return nil, translate(f.Path, err)
+	}
+	rc, err := fs.reader(f, fl, offset)
+	if err != nil {
+		fl.Close()
+		return nil, err
+	}
+	return readCloser{rc, fl}, nil
+}
+
+func (fs *FileService) reader(f *File, fl *os.File, offset int64) (io.ReadCloser, error) {
+	fi, err := fl.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s: %w", f.Path, ErrNotFound)
+	}
+	m, err := fs.readMeta(f, fi)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = fl
+	switch {
+	case !m.transformed():
+		_, err = fl.Seek(offset, io.SeekStart)
+		return ioutil.NopCloser(fl), err
+	case m.Compression == "":
+		// Encrypted chunks can be decrypted on their own, start with
+		// the one holding offset.
+		first := offset / chunkSize
+		_, err = fl.Seek(first*sealedSize, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		r, err = fs.decrypter(m, fl, first)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(ioutil.Discard, r, offset-first*chunkSize)
+		return ioutil.NopCloser(r), err
+	case m.KeyID != "":
+		r, err = fs.decrypter(m, fl, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rc, err := decompressor(m.Compression, r)
+	if err != nil {
+		return nil, err
+	}
+	// Compressed streams can only be skipped through.
+	_, err = io.CopyN(ioutil.Discard, rc, offset)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// readCloser closes both the plain content reader and the underlying file.
+type readCloser struct {
+	io.ReadCloser
+	fl *os.File
+}
+
+func (rc readCloser) Close() error {
+	rc.ReadCloser.Close()
+	return rc.fl.Close()
 }
 
 func (fs *FileService) Read(f *File, w io.Writer) error {
-	fl, err := os.Open(f.FullPath)
+	rc, err := fs.open(f, 0)
 	if err != nil {
 		return err
 	}
-	defer fl.Close()
-	_, err = io.Copy(w, fl)
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+func (fs *FileService) ReadRange(f *File, w io.Writer, offset, length int64) error {
+	rc, err := fs.open(f, offset)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.CopyN(w, rc, length)
 	return err
 }
 
 func (fs *FileService) Delete(f *File) error {
-	return os.Remove(f.FullPath)
+	loc := fs.location(f.Path)
+	fi, err := os.Stat(loc)
+	if err != nil {
+		return translate(f.Path, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s: %w", f.Path, ErrNotFound)
+	}
+	old := fs.sharedBlob(f)
+	err = os.Remove(loc)
+	if err != nil {
+		return translate(f.Path, err)
+	}
+	err = os.Remove(metaPath(loc))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fs.release(old)
+	return nil
+}
+
+// prepare makes sure the directory of f exists and f is not a directory.
+func (fs *FileService) prepare(f *File) error {
+	loc := fs.location(f.Path)
+	err := os.MkdirAll(filepath.Dir(loc), os.ModePerm)
+	if errors.Is(err, syscall.ENOTDIR) {
+		// A file is where a parent directory should be.
+		return fmt.Errorf("%s: parent is a file: %w", f.Path, ErrExists)
+	}
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(loc)
+	if err == nil && fi.IsDir() {
+		return syscall.EISDIR
+	}
+	return nil
+}
+
+// Copy copies the stored file with its sidecar, compressed or encrypted
+// content is not decoded.
+func (fs *FileService) Copy(src, dst *File) error {
+	fl, err := os.Open(fs.location(src.Path))
+	if err != nil {
+		return translate(src.Path, err)
+	}
+	defer fl.Close()
+	fi, err := fl.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s: %w", src.Path, ErrNotFound)
+	}
+	m, err := fs.readMeta(src, fi)
+	if err != nil {
+		return err
+	}
+	old := fs.sharedBlob(dst)
+	if m.Shared {
+		err = fs.link(m, dst)
+	} else {
+		err = fs.copy(fl, m, dst)
+	}
+	if err != nil {
+		return translate(dst.Path, err)
+	}
+	fs.release(old)
+	return nil
+}
+
+// link makes dst another reference to the blob described by m.
+func (fs *FileService) link(m Meta, dst *File) error {
+	err := fs.prepare(dst)
+	if err != nil {
+		return err
+	}
+	loc := fs.location(dst.Path)
+	tmp := filepath.Join(filepath.Dir(loc), tempPrefix+filepath.Base(loc)+"-link")
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	bm, ok, err := fs.linkBlob(m.SHA256, tmp)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("blob %s: %w", m.SHA256, ErrNotFound)
+	}
+	return fs.place(dst, tmp, bm)
+}
+
+func (fs *FileService) copy(r io.Reader, m Meta, dst *File) error {
+	err := fs.prepare(dst)
+	if err != nil {
+		return err
+	}
+	loc := fs.location(dst.Path)
+	tmp, err := ioutil.TempFile(filepath.Dir(loc), tempPrefix+filepath.Base(loc)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), loc)
+	if err != nil {
+		return err
+	}
+	if m.SHA256 == "" {
+		err = os.Remove(metaPath(loc))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		m.StoredSize = fi.Size()
+		m.ModTime = fi.ModTime()
+		err = fs.writeMeta(dst, m)
+	}
+	if err != nil {
+		return err
+	}
+	dst.FullPath = loc
+	if m.transformed() {
+		dst.FullPath = ""
+	}
+	return syncDir(filepath.Dir(loc))
+}
+
+// Rename moves the stored file with its sidecar to dst.
+func (fs *FileService) Rename(src, dst *File) error {
+	from := fs.location(src.Path)
+	fi, err := os.Stat(from)
+	if err != nil {
+		return translate(src.Path, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s: %w", src.Path, ErrNotFound)
+	}
+	m, err := fs.readMeta(src, fi)
+	if err != nil {
+		return err
+	}
+	err = fs.prepare(dst)
+	if err != nil {
+		return translate(dst.Path, err)
+	}
+	to := fs.location(dst.Path)
+	old := fs.sharedBlob(dst)
+	err = os.Rename(from, to)
+	if err != nil {
+		return translate(dst.Path, err)
+	}
+	// Renaming keeps the modification time, so the sidecar stays valid.
+	if m.SHA256 == "" {
+		err = os.Remove(metaPath(to))
+	} else {
+		err = os.Rename(metaPath(from), metaPath(to))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	src.FullPath = ""
+	dst.FullPath = to
+	if m.transformed() {
+		dst.FullPath = ""
+	}
+	fs.release(old)
+	err = syncDir(filepath.Dir(to))
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(from))
+}
+
+// Adopt records the checksums of a plain file that was written into the
+// directory by another process, so that it can be verified like the files
+// saved through FileService. A deduplicated file gets a copy of its own.
+func (fs *FileService) Adopt(f *File) (Info, error) {
+	fl, err := os.Open(fs.location(f.Path))
+	if err != nil {
+		return Info{}, translate(f.Path, err)
+	}
+	defer fl.Close()
+	fi, err := fl.Stat()
+	if err != nil {
+		return Info{}, err
+	}
+	if fi.IsDir() {
+		return Info{}, fmt.Errorf("%s: %w", f.Path, ErrNotFound)
+	}
+	m, err := fs.readMeta(f, fi)
+	if err != nil {
+		return Info{}, err
+	}
+	if m.transformed() {
+		// Its digest would be of the stored bytes, and the new sidecar
+		// would lose what is needed to decode them.
+		return Info{}, fmt.Errorf("%s: stored compressed or encrypted, not adopting it", f.Path)
+	}
+	if m.Shared {
+		// Still the content of its blob.
+		return fs.info(f, fi)
+	}
+	if sum := fs.sharedBlob(f); sum != "" {
+		// Written to in place through one of the links, so the content
+		// is no longer the blob's.
+		err = fs.split(f, fl, sum)
+		if err != nil {
+			return Info{}, err
+		}
+		return fs.Stat(f)
+	}
+	d := NewDigester()
+	size, err := io.Copy(d, fl)
+	if err != nil {
+		return Info{}, err
+	}
+	// A file that changes while it is read gets a stale sidecar, which is
+	// ignored.
+	err = fs.writeMeta(f, Meta{
+		SHA256:     d.SHA256(),
+		CRC32C:     d.CRC32C(),
+		Size:       size,
+		StoredSize: fi.Size(),
+		ModTime:    fi.ModTime(),
+	})
+	if err != nil {
+		return Info{}, err
+	}
+	return fs.info(f, fi)
+}
+
+// Snapshot keeps the current content of the plain file f apart from later
+// saves and deletes. It returns the path of a hard link to the content, or
+// of a copy where links are not possible, which release removes.
+func (fs *FileService) Snapshot(f *File) (string, func(), error) {
+	loc := fs.location(f.Path)
+	tmp, err := ioutil.TempFile(filepath.Dir(loc), tempPrefix+filepath.Base(loc)+"-")
+	if err != nil {
+		return "", nil, err
+	}
+	defer tmp.Close()
+	sum := fs.sharedBlob(f)
+	// Saves replace files by renaming, so the linked content stays.
+	err = os.Remove(tmp.Name())
+	if err == nil {
+		err = os.Link(loc, tmp.Name())
+	}
+	if err != nil {
+		sum = ""
+		err = copyTo(loc, tmp.Name())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, translate(f.Path, err)
+	}
+	return tmp.Name(), func() {
+		os.Remove(tmp.Name())
+		// The snapshot may have been the last reference to the blob.
+		fs.release(sum)
+	}, nil
+}
+
+func copyTo(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (fs *FileService) Stat(f *File) (Info, error) {
+	fi, err := os.Stat(fs.location(f.Path))
+	if err != nil {
+		return Info{}, translate(f.Path, err)
+	}
+	if fi.IsDir() {
+		return Info{}, fmt.Errorf("%s: %w", f.Path, ErrNotFound)
+	}
+	return fs.info(f, fi)
+}
+
+func (fs *FileService) info(f *File, fi os.FileInfo) (Info, error) {
+	m, err := fs.readMeta(f, fi)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{
+		Path:       f.Path,
+		Size:       fi.Size(),
+		StoredSize: fi.Size(),
+		ModTime:    fi.ModTime(),
+		Checksum:   m.SHA256,
+		CRC32C:     m.CRC32C,
+	}
+	if m.transformed() {
+		info.Size = m.Size
+		info.KeyID = m.KeyID
+	}
+	if m.Shared {
+		info.References = links(fi) - 1
+	}
+	if m.Compression != "" {
+		info.Compression = m.Compression
+		if info.StoredSize > 0 {
+			info.CompressionRatio = float64(info.Size) / float64(info.StoredSize)
+		}
+	}
+	return info, nil
+}
+
+func (fs *FileService) List(prefix string) ([]Info, error) {
+	return fs.ListPage(prefix, "", -1)
+}
+
+// ListDir returns the files directly in dir, not the ones in directories
+// below it. A missing dir has no files.
+func (fs *FileService) ListDir(dir string) ([]Info, error) {
+	fis, err := ioutil.ReadDir(fs.location(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var infos []Info
+	for _, fi := range fis {
+		if fi.IsDir() || isReserved(fi.Name()) {
+			continue
+		}
+		rel := path.Join(dir, fi.Name())
+		info, err := fs.info(&File{rel, fs.location(rel)}, fi)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ListPage returns up to limit files under prefix that come after the path
+// after, ordered by path. A negative limit returns all of them. Only the
+// directories that can hold such files are read.
+func (fs *FileService) ListPage(prefix, after string, limit int) ([]Info, error) {
+	var infos []Info
+	_, err := fs.walk("", prefix, after, func(f *File, fi os.FileInfo) (bool, error) {
+		info, err := fs.info(f, fi)
+		if err != nil {
+			return false, err
+		}
+		infos = append(infos, info)
+		return limit < 0 || len(infos) < limit, nil
+	})
+	return infos, err
+}
+
+// walk calls fn for the files below dir in path order, skipping the ones
+// outside prefix and up to after. It stops and reports false once fn does.
+func (fs *FileService) walk(dir, prefix, after string, fn func(*File, os.FileInfo) (bool, error)) (bool, error) {
+	fis, err := ioutil.ReadDir(fs.location(dir))
+	if os.IsNotExist(err) && dir != "" {
+		// Removed since its parent was read.
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// The paths below a directory continue with a slash, which sorts it
+	// after e.g. a file named "a-b" next to the directory "a".
+	key := func(fi os.FileInfo) string {
+		if fi.IsDir() {
+			return fi.Name() + "/"
+		}
+		return fi.Name()
+	}
+	sort.Slice(fis, func(i, j int) bool {
+		return key(fis[i]) < key(fis[j])
+	})
+	for _, fi := range fis {
+		rel := path.Join(dir, fi.Name())
+		if fi.IsDir() {
+			d := rel + "/"
+			switch {
+			case dir == "" && fi.Name() == blobDir:
+				continue
+			case !strings.HasPrefix(d, prefix) && !strings.HasPrefix(prefix, d):
+				continue
+			case d <= after && !strings.HasPrefix(after, d):
+				// Every path below d sorts before after.
+				continue
+			}
+			ok, err := fs.walk(rel, prefix, after, fn)
+			if !ok || err != nil {
+				return ok, err
+			}
+			continue
+		}
+		if isReserved(fi.Name()) || !strings.HasPrefix(rel, prefix) || rel <= after {
+			continue
+		}
+		ok, err := fn(&File{rel, fs.location(rel)}, fi)
+		if !ok || err != nil {
+			return ok, err
+		}
+	}
+	return true, nil
 }
@@ -0,0 +1,191 @@
+package file
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection dropped")
+}
+
+func TestSaveFailureKeepsOldContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Resolve("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Save(&f, strings.NewReader("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Save(&f, failingReader{})
+	if err == nil {
+		t.Fatal("Save with failing reader succeeded")
+	}
+
+	b, err := ioutil.ReadFile(f.FullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "old" {
+		t.Errorf("file content is %q after failed Save", b)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	for _, e := range entries {
+		if isTemp(e.Name()) {
+			t.Errorf("temporary file %s left after failed Save", e.Name())
+		}
+	}
+}
+
+func TestOrphanedTempFilesRemoved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	orphan := filepath.Join(dir, "sub", tempPrefix+"a.nc-123")
+	os.MkdirAll(filepath.Dir(orphan), os.ModePerm)
+	err = ioutil.WriteFile(orphan, []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphaned temp file still exists: %v", err)
+	}
+}
+
+func TestChecksumRecorded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Resolve("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Save(&f, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat(&f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Checksum != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Stat returned checksum %q", info.Checksum)
+	}
+	if info.CRC32C != "9a71bb4c" {
+		t.Errorf("Stat returned crc32c %q", info.CRC32C)
+	}
+
+	infos, err := fs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("List returned sidecar files: %v", infos)
+	}
+
+	// A file changed behind our back must not report the old checksum.
+	err = ioutil.WriteFile(f.FullPath, []byte("changed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = fs.Stat(&f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Checksum != "" {
+		t.Errorf("Stat returned stale checksum %q", info.Checksum)
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	_, err := ioutil.ReadAll(VerifyingReader(strings.NewReader("hello"), sum))
+	if err != nil {
+		t.Errorf("VerifyingReader failed on matching content: %v", err)
+	}
+	_, err = ioutil.ReadAll(VerifyingReader(strings.NewReader("hellO"), sum))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("VerifyingReader returned %v on corrupted content", err)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a/x.nc", "a-b.nc", "a/y/z.nc", "b.nc", "c/d.nc"} {
+		f, err := fs.Resolve(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.Save(&f, strings.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix, after string
+		limit         int
+		want          string
+	}{
+		{"", "", -1, "a-b.nc,a/x.nc,a/y/z.nc,b.nc,c/d.nc"},
+		{"", "", 2, "a-b.nc,a/x.nc"},
+		{"", "a/x.nc", 2, "a/y/z.nc,b.nc"},
+		{"a/", "", -1, "a/x.nc,a/y/z.nc"},
+		{"a/y", "", -1, "a/y/z.nc"},
+		{"", "a/\U0010FFFF", -1, "b.nc,c/d.nc"},
+	}
+	for _, tt := range tests {
+		infos, err := fs.ListPage(tt.prefix, tt.after, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, info := range infos {
+			got = append(got, info.Path)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("ListPage(%q, %q, %d) returned %v", tt.prefix, tt.after, tt.limit, got)
+		}
+	}
+}
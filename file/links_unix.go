@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+// Blobs and the paths linked to them are read-only, so that writing to
+// one path does not change the content of the others.
+const sharedMode = 0444
+
+// links returns the number of hard links of a file.
+func links(fi os.FileInfo) int {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Nlink)
+	}
+	return 1
+}
@@ -0,0 +1,13 @@
+package file
+
+import "os"
+
+// Read-only files cannot be replaced or removed on Windows, so blobs stay
+// writable there.
+const sharedMode = 0644
+
+// links cannot tell the number of hard links on Windows, so blobs are
+// counted as referenced and never removed.
+func links(fi os.FileInfo) int {
+	return 2
+}
@@ -0,0 +1,78 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// InvalidPathError is returned for paths that are malformed or point
+// outside of the storage root.
+type InvalidPathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *InvalidPathError) Error() string {
+	return fmt.Sprintf("Invalid path %q: %s", e.Path, e.Reason)
+}
+
+// Clean canonicalises a user supplied path into a slash separated path
+// relative to the storage root. Leading slashes are ignored, anything that
+// would climb above the root is rejected.
+func Clean(p string) (string, error) {
+	if strings.ContainsRune(p, 0) {
+		return "", &InvalidPathError{p, "contains NUL byte"}
+	}
+	c := path.Clean(strings.TrimLeft(p, "/"))
+	if c == "." || c == "" {
+		return "", &InvalidPathError{p, "empty path"}
+	}
+	if c == ".." || strings.HasPrefix(c, "../") {
+		return "", &InvalidPathError{p, "outside of storage root"}
+	}
+	if isReserved(c) {
+		return "", &InvalidPathError{p, "reserved name"}
+	}
+	return c, nil
+}
+
+// within reports whether the real location of fp, with symlinks of its
+// existing ancestors followed, is inside root.
+func within(root, fp string) (bool, error) {
+	rr, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false, err
+	}
+	existing := fp
+	rest := ""
+	for {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			return false, err
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+	rp, err := filepath.EvalSymlinks(existing)
+	if os.IsNotExist(err) {
+		// A dangling symlink, its target cannot be checked.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rp = filepath.Join(rp, rest)
+	rel, err := filepath.Rel(rr, rp)
+	if err != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
@@ -0,0 +1,147 @@
+package file
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClean(t *testing.T) {
+	valid := map[string]string{
+		"a.nc":              "a.nc",
+		"/a/b.nc":           "a/b.nc",
+		"//a//b.nc":         "a/b.nc",
+		"a/./b.nc":          "a/b.nc",
+		"a/c/../b.nc":       "a/b.nc",
+		"a/b.nc/":           "a/b.nc",
+		"model run/out.nc":  "model run/out.nc",
+		"a/..b.nc":          "a/..b.nc",
+		"/x/../y/../z.nc":   "z.nc",
+		"data/.hidden.nc":   "data/.hidden.nc",
+		"dir/file..nc":      "dir/file..nc",
+		"/a/b/c/d/../../e":  "a/b/e",
+		"a\\..\\..\\etc.nc": "a\\..\\..\\etc.nc",
+	}
+	for in, want := range valid {
+		got, err := Clean(in)
+		if err != nil {
+			t.Errorf("Clean(%q) returned error %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("Clean(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	hostile := []string{
+		"",
+		"/",
+		".",
+		"..",
+		"../etc/passwd",
+		"/../etc/passwd",
+		"a/../../etc/passwd",
+		"a/b/../../../etc/passwd",
+		"./../secret",
+		"..//..//etc",
+		"a/../..",
+		"a\x00b",
+		".upload-a.nc-123",
+		"sub/.upload-b.nc-1",
+		"sub/.meta-b.nc",
+	}
+	for _, in := range hostile {
+		_, err := Clean(in)
+		if _, ok := err.(*InvalidPathError); !ok {
+			t.Errorf("Clean(%q) returned %v, want InvalidPathError", in, err)
+		}
+	}
+}
+
+func TestResolveSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "file-test-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	dir := filepath.Join(root, "files")
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(outside, filepath.Join(dir, "escape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(outside, "x.nc"), filepath.Join(dir, "link.nc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "inner"), os.ModePerm)
+	err = os.Symlink("inner", filepath.Join(dir, "alias"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"escape/x.nc", "escape/new/dir/x.nc", "link.nc"} {
+		_, err := fs.Resolve(p)
+		if _, ok := err.(*InvalidPathError); !ok {
+			t.Errorf("Resolve(%q) returned %v, want InvalidPathError", p, err)
+		}
+	}
+
+	f, err := fs.Resolve("alias/x.nc")
+	if err != nil {
+		t.Errorf("Resolve through symlink inside root failed: %v", err)
+	}
+	if f.Path != "alias/x.nc" {
+		t.Errorf("Resolve returned path %q", f.Path)
+	}
+}
+
+func TestFileAsParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Resolve("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Save(&f, strings.NewReader("netcdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := fs.Resolve("a.nc/foo")
+	if err != nil {
+		t.Fatalf("Resolve below a file returned %v", err)
+	}
+	_, err = fs.Stat(&g)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat below a file returned %v, want ErrNotFound", err)
+	}
+	err = fs.Read(&g, ioutil.Discard)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Read below a file returned %v, want ErrNotFound", err)
+	}
+	err = fs.Save(&g, strings.NewReader("x"))
+	if !errors.Is(err, ErrExists) {
+		t.Errorf("Save below a file returned %v, want ErrExists", err)
+	}
+}
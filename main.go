@@ -3,20 +3,29 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/visheratin/storage/file"
 	"github.com/visheratin/storage/netcdf"
+	"github.com/visheratin/storage/s3"
 	"github.com/visheratin/storage/storage"
 )
 
 var s *storage.Storage
 var db *sql.DB
+var scrubber *storage.Scrubber
 
 const createMetadataTable = `CREATE TABLE IF NOT EXISTS metadata (
 	id INTEGER PRIMARY KEY,
@@ -26,8 +35,33 @@ const createMetadataTable = `CREATE TABLE IF NOT EXISTS metadata (
 	value   BLOB
 )`
 
-const insertMetadata = "INSERT INTO metadata (path, type, key, value) VALUES (?,?,?,?)"
+// indexed records the ETag of the content the metadata of every path was
+// extracted from, so that reconcile can find stale metadata. Rows written
+// before ETags were recorded hold the checksum, which is the same for files
+// that have one.
+const createIndexedTable = `CREATE TABLE IF NOT EXISTS indexed (
+	path     VARCHAR PRIMARY KEY,
+	checksum VARCHAR
+)`
+
+// Columns added after the first release. Adding a column that already
+// exists fails, which is expected for databases created since.
+var metadataMigrations = []string{
+	"ALTER TABLE metadata ADD COLUMN version VARCHAR",
+	"ALTER TABLE metadata ADD COLUMN current INTEGER NOT NULL DEFAULT 1",
+	"ALTER TABLE metadata ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0",
+}
+
+const insertMetadata = "INSERT INTO metadata (path, type, key, value, version) VALUES (?,?,?,?,?)"
 const cleanMetadata = "DELETE FROM metadata WHERE path = ?"
+const cleanVersionMetadata = "DELETE FROM metadata WHERE path = ? AND version = ?"
+const retireMetadata = "UPDATE metadata SET current = 0 WHERE path = ?"
+const hideMetadata = "UPDATE metadata SET deleted = 1 WHERE path = ? AND current = 1"
+const purgeMetadata = "DELETE FROM metadata WHERE path = ? AND deleted = 1"
+const copyMetadata = "INSERT INTO metadata (path, type, key, value, version) SELECT ?, type, key, value, ? FROM metadata WHERE path = ? AND current = 1 AND deleted = 0"
+const moveMetadata = "UPDATE metadata SET path = ? WHERE path = ? AND deleted = 0"
+const recordIndexed = "INSERT OR REPLACE INTO indexed (path, checksum) VALUES (?,?)"
+const forgetIndexed = "DELETE FROM indexed WHERE path = ?"
 
 func createDB(name string) (*sql.DB, error) {
 	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?cache=shared&mode=rwc", name))
@@ -39,6 +73,16 @@ func createDB(name string) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	_, err = db.Exec(createIndexedTable)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range metadataMigrations {
+		_, err = db.Exec(m)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return nil, err
+		}
+	}
 	return db, nil
 }
 
@@ -49,15 +93,18 @@ type Query struct {
 
 func queryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	path := ps.ByName("path")
-
-	path = strings.Replace(path, "```", "/", -1)
 	var q Query
 	err := json.NewDecoder(r.Body).Decode(&q)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	f := s.Resolve(path)
+	f, release, err := s.Local(path)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	defer release()
 	res := &netcdf.Result{}
 	res, err = netcdf.Lookup(f, q.Variable, q.Coordinates)
 
@@ -94,50 +141,420 @@ func metadataDumpHandler(w http.ResponseWriter, r *http.Request, ps httprouter.P
 	w.Write(js)
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	path := ps.ByName("path")
-	s.Read(path, w)
+func metadataHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	path, err := file.Clean(ps.ByName("path"))
+
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	var mes []netcdf.MetadataEntry
+	if v := r.URL.Query().Get("version"); v != "" {
+		mes, err = netcdf.VersionMetadata(db, path, v)
+	} else {
+		mes, err = netcdf.PathMetadata(db, path)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(mes) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	js, err := json.Marshal(mes)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
+
+// errorStatus maps storage errors to HTTP status codes, falling back to
+// def for errors without a specific mapping.
+func errorStatus(err error, def int) int {
+	switch {
+	case errors.Is(err, file.ErrInvalidPath):
+		return http.StatusBadRequest
+	case errors.Is(err, file.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, file.ErrExists):
+		return http.StatusConflict
+	case errors.Is(err, file.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, file.ErrChecksumMismatch):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrVersionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrUploadNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrIncompleteUpload):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, storage.ErrLocked):
+		return http.StatusLocked
+	}
+	return def
+}
+
+// etagList parses If-Match and If-None-Match header values into ETags.
+func etagList(h string) []string {
+	var l []string
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		l = append(l, strings.Trim(strings.TrimPrefix(t, "W/"), `"`))
+	}
+	return l
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	path := ps.ByName("path")
-	path = strings.Replace(path, "...", "/", -1)
-	err := s.Save(path, r.Body)
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		formUploadHandler(w, r, path)
+		return
+	}
+	p := storage.Precondition{
+		IfMatch:     etagList(r.Header.Get("If-Match")),
+		IfNoneMatch: etagList(r.Header.Get("If-None-Match")),
+	}
+	body := io.Reader(r.Body)
+	sum, err := requestDigest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sum != "" {
+		body = file.VerifyingReader(body, sum)
+	}
+	err = s.SaveIf(path, body, p)
 	defer r.Body.Close()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusConflict)
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
 	} else {
 		w.WriteHeader(http.StatusAccepted)
 	}
 }
 
+// copyHandler and moveHandler take the new path from the to parameter.
+func copyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	pairHandler(w, r, ps, s.Copy)
+}
+
+func moveHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	pairHandler(w, r, ps, s.Move)
+}
+
+func pairHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, op func(src, dst string) error) {
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		http.Error(w, "Missing destination", http.StatusBadRequest)
+		return
+	}
+	err := op(ps.ByName("path"), to)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
 func deleteHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	path := ps.ByName("path")
 	err := s.Delete(path)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// deprecated wraps handlers of the old single segment routes, where
+// slashes in the file name were escaped with sep.
+func deprecated(h httprouter.Handle, sep string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Deprecation", "true")
+		path := ps.ByName("path")
+		if sep != "" {
+			path = strings.Replace(path, sep, "/", -1)
+		}
+		h(w, r, httprouter.Params{{Key: "path", Value: path}})
+	}
+}
+
+type listResponse struct {
+	Files  []file.Info `json:"files"`
+	Cursor string      `json:"cursor,omitempty"`
+}
+
+func listHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q := r.URL.Query()
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	infos, cursor, err := s.List(q.Get("prefix"), q.Get("cursor"), limit)
+
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	if infos == nil {
+		infos = []file.Info{}
+	}
+
+	js, err := json.Marshal(listResponse{infos, cursor})
+
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
+
+func statHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	info, err := s.Stat(ps.ByName("path"))
+
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Type", info.ContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"`+storage.ETag(info)+`"`)
+		setDigestHeaders(w.Header(), info)
+		return
+	}
+
+	js, err := json.Marshal(info)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
+
+func versionsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	vs, err := s.Versions(ps.ByName("path"))
+
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	js, err := json.Marshal(vs)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
+
+func restoreHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	v := r.URL.Query().Get("version")
+	if v == "" {
+		http.Error(w, "Missing version", http.StatusBadRequest)
+		return
+	}
+	err := s.Restore(ps.ByName("path"), v)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
 	} else {
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
+func trashHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	es, err := s.Trash(r.URL.Query().Get("prefix"))
+
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	js, err := json.Marshal(es)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
+
+func undeleteHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := s.Undelete(ps.ByName("path"), r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func usageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	js, err := json.Marshal(s.Usage())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
+
+func deadLettersHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	js, err := json.Marshal(s.DeadLetters())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
+
+func scrubReportHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if scrubber == nil {
+		http.Error(w, "Scrubber is disabled", http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(scrubber.Report())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
+
+// catalogCheck makes the scrubber report NetCDF files that have no rows in
+// the metadata table.
+func catalogCheck(info file.Info) error {
+	if !isNetCDF(info.Path) {
+		return nil
+	}
+	mes, err := netcdf.PathMetadata(db, info.Path)
+	if err != nil {
+		return err
+	}
+	if len(mes) == 0 {
+		return fmt.Errorf("%s: no metadata in catalog", info.Path)
+	}
+	return nil
+}
+
 func newRouter(s *storage.Storage, db *sql.DB) *httprouter.Router {
 	r := httprouter.New()
-	r.GET("/download/:path", downloadHandler)
-	r.POST("/upload/:path", uploadHandler)
-	r.DELETE("/delete/:path", deleteHandler)
-	r.POST("/query/:path", queryHandler)
+	r.GET("/files", listHandler)
+	r.GET("/files/*path", downloadHandler)
+	r.HEAD("/files/*path", downloadHandler)
+	r.POST("/files/*path", uploadHandler)
+	r.PUT("/files/*path", uploadHandler)
+	r.DELETE("/files/*path", deleteHandler)
+	r.POST("/lookup/*path", queryHandler)
+	r.GET("/stat/*path", statHandler)
+	r.HEAD("/stat/*path", statHandler)
+	r.GET("/metadata/*path", metadataHandler)
 	r.GET("/catalog", metadataDumpHandler)
+	r.GET("/scrub", scrubReportHandler)
+	r.POST("/reconcile", reconcileHandler)
+	r.GET("/dead-letters", deadLettersHandler)
+	r.GET("/usage", usageHandler)
+	r.GET("/retention", retentionsHandler)
+	r.POST("/retention/*path", admin(retainHandler))
+	r.DELETE("/retention/*path", admin(releaseHandler))
+	r.GET("/audit", admin(auditHandler))
+	r.GET("/versions/*path", versionsHandler)
+	r.POST("/restore/*path", restoreHandler)
+	r.GET("/trash", trashHandler)
+	r.POST("/undelete/*path", undeleteHandler)
+	r.POST("/copy/*path", copyHandler)
+	r.POST("/move/*path", moveHandler)
+	r.GET("/archive/*path", archiveHandler)
+	r.POST("/unpack/*path", unpackHandler)
+	r.POST("/uploads", initiateUploadHandler)
+	r.GET("/uploads/:id", uploadStatusHandler)
+	r.PUT("/uploads/:id/:chunk", chunkHandler)
+	r.POST("/uploads/:id", completeUploadHandler)
+	r.DELETE("/uploads/:id", abortUploadHandler)
+
+	r.GET("/download/*path", deprecated(downloadHandler, ""))
+	r.POST("/upload/*path", deprecated(uploadHandler, "..."))
+	r.DELETE("/delete/*path", deprecated(deleteHandler, ""))
+	// Old clients escape slashes in the file name with backticks.
+	r.POST("/query/*path", deprecated(queryHandler, "```"))
 	return r
 }
 
 func registerHandlers(s *storage.Storage, db *sql.DB) {
 	cmq, _ := db.Prepare(cleanMetadata)
+	cvmq, _ := db.Prepare(cleanVersionMetadata)
+	rmq, _ := db.Prepare(retireMetadata)
+	hmq, _ := db.Prepare(hideMetadata)
+	pmq, _ := db.Prepare(purgeMetadata)
 	imq, _ := db.Prepare(insertMetadata)
+	cpmq, _ := db.Prepare(copyMetadata)
+	mvmq, _ := db.Prepare(moveMetadata)
+	riq, _ := db.Prepare(recordIndexed)
+	fiq, _ := db.Prepare(forgetIndexed)
+
+	// Without versioning rows of a replaced file are dropped, with it they
+	// stay as the metadata of the previous version.
+	retire := func(e storage.Event) error {
+		if e.Version == "" {
+			_, err := cmq.Exec(e.File.Path)
+			return err
+		}
+		_, err := rmq.Exec(e.File.Path)
+		return err
+	}
 
 	s.On(storage.Save, func(e storage.Event) error {
-		_, err := cmq.Exec(e.File.Path)
-		return err
+		if e.Version != "" {
+			_, err := cvmq.Exec(e.File.Path, e.Version)
+			if err != nil {
+				return err
+			}
+		}
+		return retire(e)
 	})
 	s.On(storage.Save, func(e storage.Event) error {
 		mr, err := netcdf.NewMetadataRequest(e.File)
@@ -146,6 +563,8 @@ func registerHandlers(s *storage.Storage, db *sql.DB) {
 			return err
 		}
 
+		mr.Version = e.Version
+
 		tx, err := db.Begin()
 		defer tx.Rollback()
 
@@ -162,17 +581,118 @@ func registerHandlers(s *storage.Storage, db *sql.DB) {
 			return err
 		}
 
+		_, err = tx.Stmt(riq).Exec(e.File.Path, e.ETag)
+
+		if err != nil {
+			return err
+		}
+
 		return tx.Commit()
 	})
 
+	// Rows of trashed files are only hidden, so that undeleting them and
+	// the trash listing keep working until the file is purged.
 	s.On(storage.Delete, func(e storage.Event) error {
-		_, err := cmq.Exec(e.File.Path)
+		_, err := fiq.Exec(e.File.Path)
+		if err != nil {
+			return err
+		}
+		if e.Soft {
+			_, err = hmq.Exec(e.File.Path)
+			return err
+		}
+		return retire(e)
+	})
+
+	s.On(storage.Purge, func(e storage.Event) error {
+		_, err := pmq.Exec(e.File.Path)
 		return err
 	})
+
+	// Copied and moved files keep their content, so their rows are
+	// rewritten instead of extracting the metadata again.
+	rewrite := func(e storage.Event) error {
+		tx, err := db.Begin()
+		defer tx.Rollback()
+
+		if err != nil {
+			return err
+		}
+
+		dst, src := e.File.Path, e.Source.Path
+		if e.Version == "" {
+			_, err = tx.Stmt(cmq).Exec(dst)
+		} else {
+			_, err = tx.Stmt(cvmq).Exec(dst, e.Version)
+			if err == nil {
+				_, err = tx.Stmt(rmq).Exec(dst)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Stmt(riq).Exec(dst, e.ETag)
+		if err == nil && e.Type == storage.Move {
+			_, err = tx.Stmt(fiq).Exec(src)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case e.Type == storage.Move && e.Version == "":
+			_, err = tx.Stmt(mvmq).Exec(dst, src)
+		case e.Type == storage.Move:
+			_, err = tx.Stmt(cpmq).Exec(dst, e.Version, src)
+			if err == nil {
+				_, err = tx.Stmt(rmq).Exec(src)
+			}
+		default:
+			_, err = tx.Stmt(cpmq).Exec(dst, e.Version, src)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	}
+	s.On(storage.Copy, rewrite)
+	s.On(storage.Move, rewrite)
 }
 
 func main() {
 	port := flag.String("port", "8000", "Defaults to 8000")
+	backend := flag.String("backend", storage.FileBackend, "Storage backend: file, memory or s3")
+	dir := flag.String("dir", "files", "Directory for the file backend")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3 endpoint URL")
+	s3Region := flag.String("s3-region", "", "S3 region")
+	s3Bucket := flag.String("s3-bucket", "", "S3 bucket")
+	compress := flag.String("compress", "", "Store files compressed with gzip or zstd")
+	compressPrefixes := flag.String("compress-prefixes", "", "Comma separated prefixes of files to compress, all files if empty")
+	compressMinSize := flag.Int64("compress-min-size", 0, "Compress only files of at least this many bytes")
+	keyFile := flag.String("keyfile", "", "File with the master keys for encryption at rest, disabled if empty")
+	dedup := flag.Bool("dedup", false, "Store identical files once, linked from every path")
+	quotas := quotaFlag{}
+	flag.Var(quotas, "quota", "Quota of a project as project=bytes[:files], bytes may have a K, M, G or T suffix, repeatable")
+	uploadDir := flag.String("upload-dir", "", "Directory for chunks of resumable uploads, within -dir or a temporary directory if empty")
+	uploadTTL := flag.Duration("upload-ttl", 24*time.Hour, "Discard resumable uploads that received no chunk for this long, 0 keeps them")
+	uploadExpireInterval := flag.Duration("upload-expire-interval", time.Hour, "Pause between removals of expired resumable uploads")
+	versioning := flag.Bool("versioning", false, "Keep previous content of overwritten and deleted files")
+	trashRetention := flag.Duration("trash-retention", 0, "Keep deleted files in the trash for this long, 0 deletes right away")
+	purgeInterval := flag.Duration("purge-interval", time.Hour, "Pause between removals of expired files from the trash")
+	scrubInterval := flag.Duration("scrub-interval", 0, "Pause between scrubber passes, 0 disables the scrubber")
+	asyncWorkers := flag.Int("async-workers", 0, "Run event handlers in the background with this many workers, 0 runs them within the request")
+	asyncQueue := flag.Int("async-queue", 1000, "Events waiting for a background worker before requests block")
+	asyncRetries := flag.Int("async-retries", 3, "Retries of a failing background handler before the event is dead-lettered")
+	asyncBackoff := flag.Duration("async-backoff", time.Second, "Pause before the first retry of a background handler, doubled for every further retry")
+	asyncMaxBackoff := flag.Duration("async-max-backoff", time.Minute, "Longest pause between retries of a background handler")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for the retention admin endpoints, which are disabled if empty")
+	reconcileAtStart := flag.Bool("reconcile", true, "Reconcile the metadata catalog with the stored files in the background at startup")
+	watchInterval := flag.Duration("watch-interval", 0, "Pause between scans for files changed in the directory of the file backend by other processes, 0 disables watching")
+	watchDebounce := flag.Duration("watch-debounce", 2*time.Second, "How long a file changed by another process must stay unchanged before it is ingested")
+	scrubRate := flag.Int64("scrub-rate", 0, "Scrubber read rate in bytes per second, 0 for unlimited")
 
 	flag.Parse()
 	var err error
@@ -183,15 +703,113 @@ func main() {
 	defer db.Close()
 
 	cfg := storage.StorageConfig{
-		Dir: "files",
+		Backend: *backend,
+		Dir:     *dir,
+		S3: s3.Config{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		},
+		Compression: file.Compression{
+			Algorithm: *compress,
+			MinSize:   *compressMinSize,
+		},
+		KeyFile:        *keyFile,
+		Dedup:          *dedup,
+		Versioning:     *versioning,
+		TrashRetention: *trashRetention,
+		UploadDir:      *uploadDir,
+		UploadTTL:      *uploadTTL,
+		Quotas:         quotas,
+		Dispatch: storage.DispatchConfig{
+			Workers:    *asyncWorkers,
+			Queue:      *asyncQueue,
+			Retries:    *asyncRetries,
+			Backoff:    *asyncBackoff,
+			MaxBackoff: *asyncMaxBackoff,
+		},
+	}
+	if *compressPrefixes != "" {
+		cfg.Compression.Prefixes = strings.Split(*compressPrefixes, ",")
 	}
 	s, err = storage.NewStorage(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if flag.Arg(0) == "rotate-keys" {
+		// Run after adding a new master key at the end of the keyfile.
+		n, err := s.RotateKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Rewrapped data keys of %d files", n)
+		return
+	}
+
 	registerHandlers(s, db)
 
+	// Also run as a command, e.g. after restoring the files or the
+	// database from a backup.
+	if flag.Arg(0) == "reconcile" {
+		err = reconcileAndLog()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Background handlers extract the metadata of reindexed files.
+		s.Flush()
+		return
+	}
+	if *reconcileAtStart {
+		// Large stores take long to list, so requests are served
+		// meanwhile.
+		go func() {
+			err := reconcileAndLog()
+			if err != nil {
+				log.Printf("Reconcile failed: %v", err)
+			}
+		}()
+	}
+
+	if *trashRetention > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go s.RunPurge(*purgeInterval, stop)
+	}
+
+	if *uploadTTL > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go s.RunExpireUploads(*uploadExpireInterval, stop)
+	}
+
+	if *scrubInterval > 0 {
+		scrubber = storage.NewScrubber(s, storage.ScrubConfig{
+			Interval:       *scrubInterval,
+			BytesPerSecond: *scrubRate,
+		})
+		scrubber.Check = catalogCheck
+		scrubber.Start()
+		defer scrubber.Stop()
+	}
+
+	if *watchInterval > 0 {
+		watcher, err := storage.NewWatcher(s, storage.WatchConfig{
+			Interval: *watchInterval,
+			Debounce: *watchDebounce,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = watcher.Start()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer watcher.Stop()
+	}
+
 	r := newRouter(s, db)
 
 	http.ListenAndServe(":"+*port, r)
@@ -0,0 +1,166 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/visheratin/storage/file"
+)
+
+type object struct {
+	data     []byte
+	modTime  time.Time
+	checksum string
+	crc32c   string
+}
+
+func (o object) info(path string) file.Info {
+	return file.Info{
+		Path:     path,
+		Size:     int64(len(o.data)),
+		ModTime:  o.modTime,
+		Checksum: o.checksum,
+		CRC32C:   o.crc32c,
+	}
+}
+
+// Backend keeps file contents in memory. It is meant for tests and
+// short-lived instances, nothing survives a restart.
+type Backend struct {
+	mu      sync.RWMutex
+	objects map[string]object
+}
+
+func NewBackend() *Backend {
+	return &Backend{
+		objects: make(map[string]object),
+	}
+}
+
+func (b *Backend) Resolve(path string) (file.File, error) {
+	p, err := file.Clean(path)
+	if err != nil {
+		return file.File{}, err
+	}
+	return file.File{Path: p}, nil
+}
+
+func (b *Backend) Save(f *file.File, r io.Reader) error {
+	buf := new(bytes.Buffer)
+	d := file.NewDigester()
+	_, err := io.Copy(io.MultiWriter(buf, d), r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[f.Path] = object{buf.Bytes(), time.Now(), d.SHA256(), d.CRC32C()}
+	return nil
+}
+
+func (b *Backend) Read(f *file.File, w io.Writer) error {
+	b.mu.RLock()
+	o, ok := b.objects[f.Path]
+	b.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%s: %w", f.Path, file.ErrNotFound)
+	}
+	_, err := w.Write(o.data)
+	return err
+}
+
+func (b *Backend) ReadRange(f *file.File, w io.Writer, offset, length int64) error {
+	b.mu.RLock()
+	o, ok := b.objects[f.Path]
+	b.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%s: %w", f.Path, file.ErrNotFound)
+	}
+	if offset < 0 || length < 0 || offset+length > int64(len(o.data)) {
+		return fmt.Errorf("%s: range %d+%d out of bounds", f.Path, offset, length)
+	}
+	_, err := w.Write(o.data[offset : offset+length])
+	return err
+}
+
+func (b *Backend) Delete(f *file.File) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.objects[f.Path]; !ok {
+		return fmt.Errorf("%s: %w", f.Path, file.ErrNotFound)
+	}
+	delete(b.objects, f.Path)
+	return nil
+}
+
+func (b *Backend) Copy(src, dst *file.File) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.objects[src.Path]
+	if !ok {
+		return fmt.Errorf("%s: %w", src.Path, file.ErrNotFound)
+	}
+	o.modTime = time.Now()
+	b.objects[dst.Path] = o
+	return nil
+}
+
+func (b *Backend) Rename(src, dst *file.File) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.objects[src.Path]
+	if !ok {
+		return fmt.Errorf("%s: %w", src.Path, file.ErrNotFound)
+	}
+	delete(b.objects, src.Path)
+	b.objects[dst.Path] = o
+	return nil
+}
+
+func (b *Backend) Stat(f *file.File) (file.Info, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	o, ok := b.objects[f.Path]
+	if !ok {
+		return file.Info{}, fmt.Errorf("%s: %w", f.Path, file.ErrNotFound)
+	}
+	return o.info(f.Path), nil
+}
+
+func (b *Backend) List(prefix string) ([]file.Info, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var infos []file.Info
+	for p, o := range b.objects {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		infos = append(infos, o.info(p))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+	return infos, nil
+}
+
+// ListPage returns up to limit files under prefix that come after the path
+// after, ordered by path. A negative limit returns all of them.
+func (b *Backend) ListPage(prefix, after string, limit int) ([]file.Info, error) {
+	infos, err := b.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	start := sort.Search(len(infos), func(i int) bool {
+		return infos[i].Path > after
+	})
+	infos = infos[start:]
+	if limit >= 0 && len(infos) > limit {
+		infos = infos[:limit]
+	}
+	return infos, nil
+}
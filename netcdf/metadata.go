@@ -19,18 +19,20 @@ const (
 )
 
 type MetadataRequest struct {
-	File *file.File
+	File    *file.File
+	Version string
 }
 
 type Metadata struct {
-	Path  string
-	Type  string
-	Key   string
-	Value interface{}
+	Path    string
+	Version string
+	Type    string
+	Key     string
+	Value   interface{}
 }
 
 func NewMetadataRequest(f *file.File) (*MetadataRequest, error) {
-	mc := &MetadataRequest{f}
+	mc := &MetadataRequest{File: f}
 	return mc, nil
 }
 
@@ -106,10 +108,11 @@ func (mr *MetadataRequest) extractGlobalAttributes(ds netcdf.Dataset) ([]Metadat
 		}
 
 		md := Metadata{
-			Path:  mr.File.Path,
-			Type:  ATTR,
-			Key:   a.Name(),
-			Value: av,
+			Path:    mr.File.Path,
+			Version: mr.Version,
+			Type:    ATTR,
+			Key:     a.Name(),
+			Value:   av,
 		}
 
 		mds = append(mds, md)
@@ -174,10 +177,11 @@ func (mc *MetadataRequest) extractVariableDimensions(v netcdf.Var) (metadata []M
 		}
 
 		md := Metadata{
-			Path:  mc.File.Path,
-			Type:  DIM,
-			Key:   n,
-			Value: fmt.Sprintf("%v", l),
+			Path:    mc.File.Path,
+			Version: mc.Version,
+			Type:    DIM,
+			Key:     n,
+			Value:   fmt.Sprintf("%v", l),
 		}
 
 		mds = append(mds, md)
@@ -226,10 +230,11 @@ func (mc *MetadataRequest) extractVariables(ds netcdf.Dataset) ([]Metadata, erro
 		}
 
 		vmd := Metadata{
-			Path:  mc.File.Path,
-			Type:  VAR,
-			Key:   name,
-			Value: joinKeys(dmds, " "),
+			Path:    mc.File.Path,
+			Version: mc.Version,
+			Type:    VAR,
+			Key:     name,
+			Value:   joinKeys(dmds, " "),
 		}
 
 		ajs, err := json.Marshal(attrs)
@@ -239,10 +244,11 @@ func (mc *MetadataRequest) extractVariables(ds netcdf.Dataset) ([]Metadata, erro
 		}
 
 		vamd := Metadata{
-			Path:  mc.File.Path,
-			Type:  VARATTR,
-			Key:   name,
-			Value: ajs,
+			Path:    mc.File.Path,
+			Version: mc.Version,
+			Type:    VARATTR,
+			Key:     name,
+			Value:   ajs,
 		}
 
 		mds = append(mds, vmd, vamd)
@@ -282,28 +288,115 @@ func (mr *MetadataRequest) Insert(stmt *sql.Stmt) (err error) {
 }
 
 type MetadataEntry struct {
-	Path  string `json:"path"`
-	Type  string `json:"type"`
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+	Type    string `json:"type"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
 }
 
-const allMetadataQuery = "SELECT DISTINCT path, type, key, value FROM metadata"
+const allMetadataQuery = "SELECT DISTINCT path, COALESCE(version, ''), type, key, value FROM metadata WHERE current = 1 AND deleted = 0"
 
 func DumpMetadata(db *sql.DB) ([]MetadataEntry, error) {
 	res, err := db.Query(allMetadataQuery)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Close()
+
+	return scanMetadata(res)
+}
+
+const pathMetadataQuery = "SELECT DISTINCT path, COALESCE(version, ''), type, key, value FROM metadata WHERE path = ? AND current = 1 AND deleted = 0"
+
+const versionMetadataQuery = "SELECT DISTINCT path, COALESCE(version, ''), type, key, value FROM metadata WHERE path = ? AND version = ?"
+
+func PathMetadata(db *sql.DB, path string) ([]MetadataEntry, error) {
+	res, err := db.Query(pathMetadataQuery, path)
+
+	if err != nil {
+		return nil, err
+	}
+
 	defer res.Close()
 
+	return scanMetadata(res)
+}
+
+func VersionMetadata(db *sql.DB, path, version string) ([]MetadataEntry, error) {
+	res, err := db.Query(versionMetadataQuery, path, version)
+
 	if err != nil {
 		return nil, err
 	}
 
+	defer res.Close()
+
+	return scanMetadata(res)
+}
+
+// Criterion matches files with a metadata row of Type and Key. An empty
+// Value matches any value.
+type Criterion struct {
+	Type  string
+	Key   string
+	Value string
+}
+
+const criterionQuery = "SELECT DISTINCT path FROM metadata WHERE current = 1 AND deleted = 0 AND type = ? AND key = ?"
+
+// MatchingPaths returns the paths of the files matching all criteria.
+func MatchingPaths(db *sql.DB, cs []Criterion) (map[string]bool, error) {
+	var paths map[string]bool
+
+	for _, c := range cs {
+		q := criterionQuery
+		args := []interface{}{c.Type, c.Key}
+		if c.Value != "" {
+			q += " AND CAST(value AS TEXT) = ?"
+			args = append(args, c.Value)
+		}
+
+		res, err := db.Query(q, args...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		matched := make(map[string]bool)
+		for res.Next() {
+			var p string
+			err = res.Scan(&p)
+			if err != nil {
+				res.Close()
+				return nil, err
+			}
+			if paths == nil || paths[p] {
+				matched[p] = true
+			}
+		}
+		err = res.Err()
+		res.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		paths = matched
+	}
+
+	return paths, nil
+}
+
+func scanMetadata(res *sql.Rows) ([]MetadataEntry, error) {
 	var es []MetadataEntry
 
 	for res.Next() {
 		var e MetadataEntry
 
-		err = res.Scan(&e.Path, &e.Type, &e.Key, &e.Value)
+		err := res.Scan(&e.Path, &e.Version, &e.Type, &e.Key, &e.Value)
 
 		if err != nil {
 			return nil, err
@@ -312,7 +405,7 @@ func DumpMetadata(db *sql.DB) ([]MetadataEntry, error) {
 		es = append(es, e)
 	}
 
-	return es, nil
+	return es, res.Err()
 }
 
 func insertMetadata(mds []Metadata, stmt *sql.Stmt) error {
@@ -321,7 +414,8 @@ func insertMetadata(mds []Metadata, stmt *sql.Stmt) error {
 			md.Path,
 			md.Type,
 			md.Key,
-			md.Value)
+			md.Value,
+			md.Version)
 
 		if err != nil {
 			return err
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/visheratin/storage/storage"
+)
+
+// quotaFlag collects -quota flags of the form project=bytes[:files].
+type quotaFlag map[string]storage.Quota
+
+func (qf quotaFlag) String() string {
+	var l []string
+	for p, q := range qf {
+		l = append(l, fmt.Sprintf("%s=%d:%d", p, q.Bytes, q.Files))
+	}
+	return strings.Join(l, ",")
+}
+
+func (qf quotaFlag) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || strings.Contains(kv[0], "/") {
+		return fmt.Errorf("expected project=bytes[:files], got %q", v)
+	}
+	var q storage.Quota
+	limits := strings.SplitN(kv[1], ":", 2)
+	var err error
+	if limits[0] != "" {
+		q.Bytes, err = parseSize(limits[0])
+		if err != nil {
+			return err
+		}
+	}
+	if len(limits) == 2 {
+		q.Files, err = strconv.ParseInt(limits[1], 10, 64)
+		if err != nil || q.Files < 0 {
+			return fmt.Errorf("invalid file count %q", limits[1])
+		}
+	}
+	qf[kv[0]] = q
+	return nil
+}
+
+// parseSize parses a byte count with an optional binary K, M, G or T suffix.
+func parseSize(v string) (int64, error) {
+	mult := int64(1)
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	}
+	if mult > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/visheratin/storage/storage"
+)
+
+func TestQuotaFlag(t *testing.T) {
+	qf := quotaFlag{}
+	for _, v := range []string{"cmip=20G:1000", "era5=512M", "obs=:10"} {
+		err := qf.Set(v)
+		if err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	want := map[string]storage.Quota{
+		"cmip": {Bytes: 20 << 30, Files: 1000},
+		"era5": {Bytes: 512 << 20},
+		"obs":  {Files: 10},
+	}
+	for p, q := range want {
+		if qf[p] != q {
+			t.Errorf("quota of %s is %+v, want %+v", p, qf[p], q)
+		}
+	}
+	for _, v := range []string{"cmip", "=1G", "a/b=1G", "cmip=xG", "cmip=1G:x"} {
+		if qf.Set(v) == nil {
+			t.Errorf("Set(%q) succeeded", v)
+		}
+	}
+}
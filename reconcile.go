@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/storage"
+)
+
+const indexedQuery = "SELECT path, COALESCE(checksum, '') FROM indexed"
+const catalogPathsQuery = "SELECT DISTINCT path FROM metadata WHERE current = 1 AND deleted = 0"
+const removeMetadata = "DELETE FROM metadata WHERE path = ? AND current = 1 AND deleted = 0"
+
+type ReconcileReport struct {
+	Checked   int               `json:"checked"`
+	Reindexed []string          `json:"reindexed"`
+	Removed   []string          `json:"removed"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+// catalog is the part of the metadata database reconcile works on.
+type catalog interface {
+	// indexed returns the ETags of the files the current metadata was
+	// extracted from.
+	indexed() (map[string]string, error)
+	// paths returns the files with current metadata.
+	paths() (map[string]bool, error)
+	// forget removes the current metadata of a file.
+	forget(p string) error
+}
+
+type sqlCatalog struct {
+	db *sql.DB
+}
+
+func isNetCDF(p string) bool {
+	ext := path.Ext(p)
+	return ext == ".nc" || ext == ".nc4"
+}
+
+// reconcile brings the metadata catalog in line with the stored files. It
+// extracts the metadata of NetCDF files that have none or whose content
+// changed since, and removes the rows of files that are gone.
+func reconcile(s *storage.Storage, c catalog) (ReconcileReport, error) {
+	rep := ReconcileReport{Reindexed: []string{}, Removed: []string{}}
+	indexed, err := c.indexed()
+	if err != nil {
+		return rep, err
+	}
+	catalogued, err := c.paths()
+	if err != nil {
+		return rep, err
+	}
+	for p := range indexed {
+		catalogued[p] = true
+	}
+
+	fail := func(p string, err error) {
+		if rep.Errors == nil {
+			rep.Errors = make(map[string]string)
+		}
+		rep.Errors[p] = err.Error()
+	}
+	cursor := ""
+	for {
+		infos, next, err := s.List("", cursor, 0)
+		if err != nil {
+			return rep, err
+		}
+		for _, info := range infos {
+			delete(catalogued, info.Path)
+			if !isNetCDF(info.Path) {
+				continue
+			}
+			rep.Checked++
+			if info.Checksum == "" {
+				// Not in the listings of every backend, e.g. S3, and
+				// the ETag of a file without one is made from the
+				// modification time Stat reports.
+				info, err = s.Stat(info.Path)
+				if errors.Is(err, file.ErrNotFound) {
+					continue
+				}
+				if err != nil {
+					fail(info.Path, err)
+					continue
+				}
+			}
+			if etag, ok := indexed[info.Path]; ok && etag == storage.ETag(info) {
+				continue
+			}
+			err = s.Reindex(info.Path)
+			if err != nil {
+				fail(info.Path, err)
+				continue
+			}
+			rep.Reindexed = append(rep.Reindexed, info.Path)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	for p := range catalogued {
+		// Saved since the listing.
+		_, err = s.Stat(p)
+		if !errors.Is(err, file.ErrNotFound) {
+			continue
+		}
+		err = c.forget(p)
+		if err != nil {
+			fail(p, err)
+			continue
+		}
+		rep.Removed = append(rep.Removed, p)
+	}
+	return rep, nil
+}
+
+// reconcileAndLog reconciles the catalog of the server and logs the report.
+func reconcileAndLog() error {
+	rep, err := reconcile(s, sqlCatalog{db})
+	if err != nil {
+		return err
+	}
+	log.Printf("Reconciled %d files: %d reindexed, %d removed, %d failed",
+		rep.Checked, len(rep.Reindexed), len(rep.Removed), len(rep.Errors))
+	for p, msg := range rep.Errors {
+		log.Printf("Failed to reconcile %s: %s", p, msg)
+	}
+	return nil
+}
+
+func (c sqlCatalog) indexed() (map[string]string, error) {
+	rows, err := c.db.Query(indexedQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string]string)
+	for rows.Next() {
+		var p, sum string
+		err = rows.Scan(&p, &sum)
+		if err != nil {
+			return nil, err
+		}
+		res[p] = sum
+	}
+	return res, rows.Err()
+}
+
+func (c sqlCatalog) paths() (map[string]bool, error) {
+	rows, err := c.db.Query(catalogPathsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string]bool)
+	for rows.Next() {
+		var p string
+		err = rows.Scan(&p)
+		if err != nil {
+			return nil, err
+		}
+		res[p] = true
+	}
+	return res, rows.Err()
+}
+
+// forget removes the current rows of a file that no longer exists. Rows of
+// trashed files and of old versions stay.
+func (c sqlCatalog) forget(p string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(removeMetadata, p)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(forgetIndexed, p)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func reconcileHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rep, err := reconcile(s, sqlCatalog{db})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(rep)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
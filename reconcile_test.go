@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/memory"
+	"github.com/visheratin/storage/storage"
+)
+
+type fakeCatalog struct {
+	sums      map[string]string
+	catalog   map[string]bool
+	forgotten []string
+}
+
+func (c *fakeCatalog) indexed() (map[string]string, error) {
+	res := make(map[string]string)
+	for p, sum := range c.sums {
+		res[p] = sum
+	}
+	return res, nil
+}
+
+func (c *fakeCatalog) paths() (map[string]bool, error) {
+	res := make(map[string]bool)
+	for p := range c.catalog {
+		res[p] = true
+	}
+	return res, nil
+}
+
+func (c *fakeCatalog) forget(p string) error {
+	c.forgotten = append(c.forgotten, p)
+	return nil
+}
+
+// unsummedListing lists files without checksums, like S3 does.
+type unsummedListing struct {
+	*memory.Backend
+}
+
+func (b unsummedListing) ListPage(prefix, after string, limit int) ([]file.Info, error) {
+	infos, err := b.Backend.ListPage(prefix, after, limit)
+	for i := range infos {
+		infos[i].Checksum = ""
+	}
+	return infos, err
+}
+
+func TestReconcile(t *testing.T) {
+	s := storage.NewStorageWithBackend(storage.StorageConfig{}, unsummedListing{memory.NewBackend()})
+	for _, p := range []string{"new.nc", "stale.nc", "current.nc4", "notes.txt"} {
+		err := s.Save(p, strings.NewReader("content of "+p))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := s.Stat("current.nc4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reindexed []string
+	s.On(storage.Save, func(e storage.Event) error {
+		reindexed = append(reindexed, e.File.Path)
+		return nil
+	})
+
+	c := &fakeCatalog{
+		sums: map[string]string{
+			"stale.nc":    "0123",
+			"current.nc4": info.Checksum,
+			"removed.nc":  "4567",
+		},
+		catalog: map[string]bool{"current.nc4": true, "removed.nc": true},
+	}
+	rep, err := reconcile(s, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Checked != 3 || len(rep.Errors) != 0 {
+		t.Errorf("report is %+v", rep)
+	}
+	if got := strings.Join(rep.Reindexed, ","); got != "new.nc,stale.nc" {
+		t.Errorf("reindexed %s", got)
+	}
+	if got := strings.Join(reindexed, ","); got != "new.nc,stale.nc" {
+		t.Errorf("Save events for %s", got)
+	}
+	if got := strings.Join(c.forgotten, ","); got != "removed.nc" || len(rep.Removed) != 1 {
+		t.Errorf("forgot %s, removed %v", got, rep.Removed)
+	}
+}
+
+// unsummedBackend records no checksums at all.
+type unsummedBackend struct {
+	unsummedListing
+}
+
+func (b unsummedBackend) Stat(f *file.File) (file.Info, error) {
+	info, err := b.Backend.Stat(f)
+	info.Checksum = ""
+	return info, err
+}
+
+func TestReconcileWithoutChecksums(t *testing.T) {
+	s := storage.NewStorageWithBackend(storage.StorageConfig{}, unsummedBackend{unsummedListing{memory.NewBackend()}})
+	for _, p := range []string{"same.nc", "changed.nc", "legacy.nc"} {
+		err := s.Save(p, strings.NewReader("content of "+p))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	etags := make(map[string]string)
+	for _, p := range []string{"same.nc", "changed.nc"} {
+		info, err := s.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		etags[p] = storage.ETag(info)
+	}
+	err := s.Save("changed.nc", strings.NewReader("new content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &fakeCatalog{
+		sums:    map[string]string{"same.nc": etags["same.nc"], "changed.nc": etags["changed.nc"], "legacy.nc": ""},
+		catalog: map[string]bool{},
+	}
+	rep, err := reconcile(s, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(rep.Reindexed, ","); got != "changed.nc,legacy.nc" {
+		t.Errorf("reindexed %s", got)
+	}
+}
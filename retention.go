@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// adminToken must be sent as a bearer token to the handlers wrapped with
+// admin. They are disabled while it is empty.
+var adminToken string
+
+// admin restricts h to holders of adminToken.
+func admin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if adminToken == "" {
+			http.Error(w, "Admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// retainHandler locks a path until the RFC 3339 time in until, or
+// indefinitely without it. A path with a trailing slash locks a prefix.
+func retainHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var until time.Time
+	if v := r.URL.Query().Get("until"); v != "" {
+		var err error
+		until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "Invalid until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	l, err := s.Retain(ps.ByName("path"), until, r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	js, err := json.Marshal(l)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
+
+func releaseHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := s.Release(ps.ByName("path"), r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func retentionsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ls, err := s.Retentions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(ls)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	es, err := s.RetentionAudit()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(es)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(js)
+}
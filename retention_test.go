@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestAdmin(t *testing.T) {
+	defer func(old string) { adminToken = old }(adminToken)
+	h := admin(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	cases := []struct {
+		token, header string
+		status        int
+	}{
+		{"", "", http.StatusForbidden},
+		{"", "Bearer ", http.StatusForbidden},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusNoContent},
+	}
+	for _, c := range cases {
+		adminToken = c.token
+		r := httptest.NewRequest(http.MethodDelete, "/retention/a.nc", nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		if w.Code != c.status {
+			t.Errorf("token %q, header %q: status %d, want %d", c.token, c.header, w.Code, c.status)
+		}
+	}
+}
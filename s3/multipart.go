@@ -0,0 +1,198 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// A single PUT or PUT-copy is limited to 5 GiB, larger objects are sent
+// in parts of partSize bytes. Variables so tests can lower them.
+var (
+	maxSinglePut int64 = 5 << 30
+	partSize     int64 = 256 << 20
+)
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipart is an upload started with CreateMultipartUpload.
+type multipart struct {
+	b     *Backend
+	key   string
+	id    string
+	parts []completedPart
+}
+
+// startMultipart starts a multipart upload of key. hdr carries the
+// object's metadata, which parts cannot set.
+func (b *Backend) startMultipart(key string, hdr http.Header) (*multipart, error) {
+	q := url.Values{}
+	q.Set("uploads", "")
+	resp, err := b.do(http.MethodPost, key, q, hdr, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, responseError(resp)
+	}
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	if res.UploadID == "" {
+		return nil, fmt.Errorf("s3: %s: no upload id", key)
+	}
+	return &multipart{b: b, key: key, id: res.UploadID}, nil
+}
+
+func (m *multipart) query(part int) url.Values {
+	q := url.Values{}
+	q.Set("uploadId", m.id)
+	if part > 0 {
+		q.Set("partNumber", strconv.Itoa(part))
+	}
+	return q
+}
+
+// upload sends the next part of the object.
+func (m *multipart) upload(body io.ReadSeeker) error {
+	h := sha256.New()
+	_, err := io.Copy(h, body)
+	if err != nil {
+		return err
+	}
+	n := len(m.parts) + 1
+	resp, err := m.b.do(http.MethodPut, m.key, m.query(n), nil, body, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+	m.parts = append(m.parts, completedPart{n, resp.Header.Get("ETag")})
+	return nil
+}
+
+// copy copies the bytes [offset, offset+length) of src as the next part.
+func (m *multipart) copy(src string, offset, length int64) error {
+	n := len(m.parts) + 1
+	hdr := http.Header{}
+	hdr.Set("X-Amz-Copy-Source", src)
+	hdr.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := m.b.do(http.MethodPut, m.key, m.query(n), hdr, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+	var res struct {
+		ETag string `xml:"ETag"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return err
+	}
+	m.parts = append(m.parts, completedPart{n, res.ETag})
+	return nil
+}
+
+func (m *multipart) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: m.parts})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	resp, err := m.b.do(http.MethodPost, m.key, m.query(0), nil, bytes.NewReader(body), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+	// S3 can report a failed completion with a 200 and an error body.
+	var res struct {
+		XMLName xml.Name
+		Message string `xml:"Message"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&res)
+	if err == nil && res.XMLName.Local == "Error" {
+		return fmt.Errorf("s3: %s: %s", m.key, res.Message)
+	}
+	return nil
+}
+
+// abort discards the uploaded parts.
+func (m *multipart) abort() {
+	resp, err := m.b.do(http.MethodDelete, m.key, m.query(0), nil, nil, "")
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// partLen is the length of the part starting at off.
+func partLen(off, size int64) int64 {
+	if size-off < partSize {
+		return size - off
+	}
+	return partSize
+}
+
+// saveMultipart uploads the size bytes of r in parts.
+func (b *Backend) saveMultipart(key string, hdr http.Header, r io.ReaderAt, size int64) error {
+	m, err := b.startMultipart(key, hdr)
+	if err != nil {
+		return err
+	}
+	for off := int64(0); off < size; off += partSize {
+		err = m.upload(io.NewSectionReader(r, off, partLen(off, size)))
+		if err != nil {
+			m.abort()
+			return err
+		}
+	}
+	err = m.complete()
+	if err != nil {
+		m.abort()
+	}
+	return err
+}
+
+// copyMultipart copies the size bytes of the object src with UploadPartCopy.
+func (b *Backend) copyMultipart(src, key string, hdr http.Header, size int64) error {
+	m, err := b.startMultipart(key, hdr)
+	if err != nil {
+		return err
+	}
+	for off := int64(0); off < size; off += partSize {
+		err = m.copy(src, off, partLen(off, size))
+		if err != nil {
+			m.abort()
+			return err
+		}
+	}
+	err = m.complete()
+	if err != nil {
+		m.abort()
+	}
+	return err
+}
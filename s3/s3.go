@@ -0,0 +1,305 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/visheratin/storage/file"
+)
+
+type Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// The SHA-256 of every object is kept in its user metadata.
+const checksumHeader = "X-Amz-Meta-Sha256"
+
+// Backend stores files as objects in an S3-compatible bucket using
+// path-style requests, so it works against MinIO and similar servers.
+type Backend struct {
+	Config Config
+	client *http.Client
+}
+
+func NewBackend(cfg Config) (*Backend, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3: endpoint and bucket are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return &Backend{
+		Config: cfg,
+		client: http.DefaultClient,
+	}, nil
+}
+
+func (b *Backend) objectURL(key string, q url.Values) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimRight(b.Config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + b.Config.Bucket + "/" + key
+	u.RawPath = "/" + escape(b.Config.Bucket, false) + "/" + escape(key, true)
+	u.RawQuery = canonicalQuery(q)
+	return u, nil
+}
+
+func (b *Backend) do(method, key string, q url.Values, hdr http.Header, body io.ReadSeeker, payloadHash string) (*http.Response, error) {
+	u, err := b.objectURL(key, q)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		size, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		_, err = body.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+	}
+	if payloadHash == "" {
+		payloadHash = emptyHash
+	}
+	b.sign(req, payloadHash, time.Now())
+	return b.client.Do(req)
+}
+
+func responseError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("s3: %s: %w", resp.Request.URL.Path, file.ErrNotFound)
+	case http.StatusForbidden:
+		return fmt.Errorf("s3: %s: %w", resp.Request.URL.Path, file.ErrPermission)
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (b *Backend) Resolve(path string) (file.File, error) {
+	p, err := file.Clean(path)
+	if err != nil {
+		return file.File{}, err
+	}
+	return file.File{Path: p}, nil
+}
+
+func (b *Backend) Save(f *file.File, r io.Reader) error {
+	// S3 needs the content length and hash up front, so the body is
+	// spooled to a temporary file first.
+	tmp, err := ioutil.TempFile("", "s3-upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	hdr := http.Header{}
+	hdr.Set(checksumHeader, sum)
+	if size > maxSinglePut {
+		return b.saveMultipart(f.Path, hdr, tmp, size)
+	}
+	resp, err := b.do(http.MethodPut, f.Path, nil, hdr, tmp, sum)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// Copy copies an object within the bucket without downloading it. The
+// checksum metadata is copied along with the content. Objects above the
+// PUT-copy limit are copied in parts.
+func (b *Backend) Copy(src, dst *file.File) error {
+	source := "/" + escape(b.Config.Bucket, false) + "/" + escape(src.Path, true)
+	info, err := b.Stat(src)
+	if err != nil {
+		return err
+	}
+	hdr := http.Header{}
+	if info.Size > maxSinglePut {
+		hdr.Set(checksumHeader, info.Checksum)
+		return b.copyMultipart(source, dst.Path, hdr, info.Size)
+	}
+	hdr.Set("X-Amz-Copy-Source", source)
+	resp, err := b.do(http.MethodPut, dst.Path, nil, hdr, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func (b *Backend) Read(f *file.File, w io.Writer) error {
+	resp, err := b.do(http.MethodGet, f.Path, nil, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (b *Backend) ReadRange(f *file.File, w io.Writer, offset, length int64) error {
+	hdr := http.Header{}
+	hdr.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := b.do(http.MethodGet, f.Path, nil, hdr, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	body := io.Reader(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		// The server ignored the range, skip to the requested part.
+		_, err = io.CopyN(ioutil.Discard, resp.Body, offset)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.CopyN(w, body, length)
+	return err
+}
+
+func (b *Backend) Delete(f *file.File) error {
+	_, err := b.Stat(f)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(http.MethodDelete, f.Path, nil, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func (b *Backend) Stat(f *file.File) (file.Info, error) {
+	resp, err := b.do(http.MethodHead, f.Path, nil, nil, nil, "")
+	if err != nil {
+		return file.Info{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return file.Info{}, responseError(resp)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return file.Info{}, err
+	}
+	mt, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return file.Info{
+		Path:     f.Path,
+		Size:     size,
+		ModTime:  mt,
+		Checksum: resp.Header.Get(checksumHeader),
+	}, nil
+}
+
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *Backend) List(prefix string) ([]file.Info, error) {
+	return b.ListPage(prefix, "", -1)
+}
+
+// ListPage returns up to limit files under prefix that come after the path
+// after, ordered by path. A negative limit returns all of them.
+func (b *Backend) ListPage(prefix, after string, limit int) ([]file.Info, error) {
+	var infos []file.Info
+	token := ""
+	for limit < 0 || len(infos) < limit {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if after != "" {
+			q.Set("start-after", after)
+		}
+		if limit >= 0 {
+			q.Set("max-keys", strconv.Itoa(limit-len(infos)))
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := b.do(http.MethodGet, "", q, nil, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = responseError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var lr listResult
+		err = xml.NewDecoder(resp.Body).Decode(&lr)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range lr.Contents {
+			infos = append(infos, file.Info{Path: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !lr.IsTruncated {
+			break
+		}
+		token = lr.NextContinuationToken
+	}
+	return infos, nil
+}
@@ -0,0 +1,289 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/visheratin/storage/file"
+)
+
+// fakeS3 is a minimal stand-in for an S3 server with a single bucket.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	sums    map[string]string
+	uploads map[string]*fakeUpload
+}
+
+type fakeUpload struct {
+	key   string
+	sum   string
+	parts map[int][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), algorithm) {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/"+s.bucket+"/")
+	q := r.URL.Query()
+	up := s.uploads[q.Get("uploadId")]
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		if s.uploads == nil {
+			s.uploads = make(map[string]*fakeUpload)
+		}
+		id := strconv.Itoa(len(s.uploads) + 1)
+		s.uploads[id] = &fakeUpload{key: key, sum: r.Header.Get(checksumHeader), parts: make(map[int][]byte)}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case q.Get("uploadId") != "" && (up == nil || up.key != key):
+		http.NotFound(w, r)
+	case r.Method == http.MethodPut && q.Get("partNumber") != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(strings.TrimPrefix(src, "/"+s.bucket+"/"))
+			var from, to int
+			fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &from, &to)
+			up.parts[n] = s.objects[src][from : to+1]
+			fmt.Fprintf(w, "<CopyPartResult><ETag>\"%d\"</ETag></CopyPartResult>", n)
+			return
+		}
+		up.parts[n], _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", n))
+	case r.Method == http.MethodPost:
+		var req struct {
+			Parts []struct{ PartNumber int } `xml:"Part"`
+		}
+		xml.NewDecoder(r.Body).Decode(&req)
+		var b []byte
+		for _, p := range req.Parts {
+			b = append(b, up.parts[p.PartNumber]...)
+		}
+		s.objects[key] = b
+		s.sums[key] = up.sum
+		delete(s.uploads, q.Get("uploadId"))
+	case r.Method == http.MethodDelete && up != nil:
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && key == "":
+		type content struct {
+			Key  string
+			Size int64
+		}
+		res := struct {
+			XMLName               xml.Name `xml:"ListBucketResult"`
+			Contents              []content
+			IsTruncated           bool
+			NextContinuationToken string
+		}{}
+		after := q.Get("start-after")
+		if q.Get("continuation-token") != "" {
+			after = q.Get("continuation-token")
+		}
+		for k, v := range s.objects {
+			if strings.HasPrefix(k, q.Get("prefix")) && k > after {
+				res.Contents = append(res.Contents, content{k, int64(len(v))})
+			}
+		}
+		sort.Slice(res.Contents, func(i, j int) bool {
+			return res.Contents[i].Key < res.Contents[j].Key
+		})
+		max := 2
+		if q.Get("max-keys") != "" {
+			max, _ = strconv.Atoi(q.Get("max-keys"))
+		}
+		if len(res.Contents) > max {
+			res.Contents = res.Contents[:max]
+			res.IsTruncated = true
+			res.NextContinuationToken = res.Contents[max-1].Key
+		}
+		xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"+s.bucket+"/"))
+		b, ok := s.objects[src]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.objects[key] = b
+		s.sums[key] = s.sums[src]
+	case r.Method == http.MethodPut:
+		b, _ := ioutil.ReadAll(r.Body)
+		s.objects[key] = b
+		s.sums[key] = r.Header.Get(checksumHeader)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		b, ok := s.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Header().Set(checksumHeader, s.sums[key])
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	srv := httptest.NewServer(&fakeS3{bucket: "data", objects: make(map[string][]byte), sums: make(map[string]string)})
+	defer srv.Close()
+
+	b, err := NewBackend(Config{Endpoint: srv.URL, Bucket: "data", AccessKey: "key", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := b.Resolve("model/run 1/out.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Save(&f, strings.NewReader("netcdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	err = b.Read(&f, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "netcdf" {
+		t.Errorf("Read returned %q", buf.String())
+	}
+
+	info, err := b.Stat(&f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 6 || len(info.Checksum) != 64 {
+		t.Errorf("Stat returned %+v", info)
+	}
+
+	infos, err := b.List("model/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Path != f.Path {
+		t.Errorf("List returned %v", infos)
+	}
+
+	cp, err := b.Resolve("model/copy.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Copy(&f, &cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cinfo, err := b.Stat(&cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cinfo.Checksum != info.Checksum {
+		t.Errorf("copy has checksum %q, want %q", cinfo.Checksum, info.Checksum)
+	}
+
+	err = b.Delete(&f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := file.File{Path: f.Path}
+	err = b.Read(&missing, buf)
+	if !errors.Is(err, file.ErrNotFound) {
+		t.Errorf("Read after Delete returned %v", err)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	srv := httptest.NewServer(&fakeS3{bucket: "data", objects: make(map[string][]byte), sums: make(map[string]string)})
+	defer srv.Close()
+
+	b, err := NewBackend(Config{Endpoint: srv.URL, Bucket: "data", AccessKey: "key", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a/1.nc", "a/2.nc", "a/3.nc", "a/4.nc", "a/5.nc", "b.nc"} {
+		f, err := b.Resolve(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Save(&f, strings.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos, err := b.ListPage("a/", "a/1.nc", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, info := range infos {
+		got = append(got, info.Path)
+	}
+	if strings.Join(got, ",") != "a/2.nc,a/3.nc,a/4.nc" {
+		t.Errorf("ListPage returned %v", got)
+	}
+
+	infos, err = b.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 6 {
+		t.Errorf("List returned %d files over truncated pages", len(infos))
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	defer func(max, part int64) { maxSinglePut, partSize = max, part }(maxSinglePut, partSize)
+	maxSinglePut, partSize = 8, 4
+
+	fake := &fakeS3{bucket: "data", objects: make(map[string][]byte), sums: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	b, err := NewBackend(Config{Endpoint: srv.URL, Bucket: "data", AccessKey: "key", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := file.File{Path: "big.nc"}
+	err = b.Save(&f, strings.NewReader("netcdf data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := file.File{Path: "copy.nc"}
+	err = b.Copy(&f, &cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"big.nc", "copy.nc"} {
+		if got := string(fake.objects[p]); got != "netcdf data" {
+			t.Errorf("%s holds %q", p, got)
+		}
+		if len(fake.sums[p]) != 64 {
+			t.Errorf("%s has checksum %q", p, fake.sums[p])
+		}
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("%d uploads left open", len(fake.uploads))
+	}
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/visheratin/storage/file"
+)
+
+const (
+	TarFormat   = "tar"
+	TarGzFormat = "tar.gz"
+	ZipFormat   = "zip"
+)
+
+// archiveWriter adds files to an archive one after another.
+type archiveWriter interface {
+	Create(info file.Info) (io.Writer, error)
+	Close() error
+}
+
+type tarWriter struct {
+	*tar.Writer
+}
+
+func (tw tarWriter) Create(info file.Info) (io.Writer, error) {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     info.Path,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     info.Size,
+		ModTime:  info.ModTime,
+	})
+	return tw.Writer, err
+}
+
+type tarGzWriter struct {
+	tarWriter
+	gw *gzip.Writer
+}
+
+func (tw tarGzWriter) Close() error {
+	err := tw.tarWriter.Close()
+	if err != nil {
+		return err
+	}
+	return tw.gw.Close()
+}
+
+type zipWriter struct {
+	*zip.Writer
+}
+
+func (zw zipWriter) Create(info file.Info) (io.Writer, error) {
+	return zw.CreateHeader(&zip.FileHeader{
+		Name:     info.Path,
+		Method:   zip.Deflate,
+		Modified: info.ModTime,
+	})
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case TarFormat:
+		return tarWriter{tar.NewWriter(w)}, nil
+	case TarGzFormat:
+		gw := gzip.NewWriter(w)
+		return tarGzWriter{tarWriter{tar.NewWriter(gw)}, gw}, nil
+	case ZipFormat:
+		return zipWriter{zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("Unknown archive format: %s", format)
+}
+
+// Archive streams an archive in format with every file under prefix for
+// which include returns true, or all of them if include is nil. Files are
+// read one by one, each of them fires a Read event. Files deleted while
+// the archive is written are left out.
+func (s *Storage) Archive(w io.Writer, format, prefix string, include func(file.Info) bool) error {
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	prefix = strings.TrimLeft(prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	cursor := ""
+	for {
+		infos, next, err := s.List(prefix, cursor, 0)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if include != nil && !include(info) {
+				continue
+			}
+			err = s.readWithInfo(info.Path, aw.Create)
+			if errors.Is(err, file.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return aw.Close()
+}
+
+// readWithInfo reads the file at path into the writer open returns for the
+// file. The information passed to open and the content are taken under the
+// same lock, so that they match.
+func (s *Storage) readWithInfo(path string, open func(file.Info) (io.Writer, error)) error {
+	return s.ReadWithInfo(path, func(info file.Info) (io.Writer, int64, int64, error) {
+		w, err := open(info)
+		return w, 0, info.Size, err
+	})
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/visheratin/storage/file"
+)
+
+func TestArchive(t *testing.T) {
+	for _, format := range []string{TarFormat, TarGzFormat, ZipFormat} {
+		s := newMemoryStorage()
+		for _, p := range []string{"exp1/a.nc", "exp1/sub/b.nc", "exp1/c.txt", "exp10/d.nc"} {
+			err := s.Save(p, strings.NewReader("content of "+p))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var reads []string
+		s.On(Read, func(e Event) error {
+			reads = append(reads, e.File.Path)
+			return nil
+		})
+
+		buf := &bytes.Buffer{}
+		err := s.Archive(buf, format, "exp1", func(info file.Info) bool {
+			return path.Ext(info.Path) == ".nc"
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if len(reads) != 2 {
+			t.Errorf("%s: Read events for %v", format, reads)
+		}
+
+		res, err := newMemoryStorage().Unpack("copy", buf)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if len(res) != 2 || res[0].Path != "copy/exp1/a.nc" || res[1].Path != "copy/exp1/sub/b.nc" {
+			t.Errorf("%s: archive holds %+v", format, res)
+		}
+	}
+}
+
+func TestArchiveOfChangingFiles(t *testing.T) {
+	s := newMemoryStorage()
+	for _, p := range []string{"a.nc", "b.nc", "c.nc"} {
+		err := s.Save(p, strings.NewReader("short"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	err := s.Archive(buf, TarFormat, "", func(info file.Info) bool {
+		// Changed after the listing, before the file is archived.
+		switch info.Path {
+		case "a.nc":
+			s.Save(info.Path, strings.NewReader("much longer content"))
+		case "b.nc":
+			s.Delete(info.Path)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := newMemoryStorage().Unpack("copy", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Path != "copy/a.nc" || res[0].Size != 19 || res[1].Path != "copy/c.nc" {
+		t.Errorf("archive holds %+v", res)
+	}
+}
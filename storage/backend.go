@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/memory"
+	"github.com/visheratin/storage/s3"
+)
+
+// Backend is the place where file contents actually live. Resolve may
+// return a File without FullPath when the backend has no local copy.
+type Backend interface {
+	Resolve(path string) (file.File, error)
+	Save(f *file.File, r io.Reader) error
+	Read(f *file.File, w io.Writer) error
+	ReadRange(f *file.File, w io.Writer, offset, length int64) error
+	Delete(f *file.File) error
+	Stat(f *file.File) (file.Info, error)
+	List(prefix string) ([]file.Info, error)
+	// ListPage returns up to limit files under prefix that come after the
+	// path after, ordered by path.
+	ListPage(prefix, after string, limit int) ([]file.Info, error)
+}
+
+// Backends that can copy or rename files on their own implement these,
+// otherwise Storage streams the content through itself.
+type copier interface {
+	Copy(src, dst *file.File) error
+}
+
+type renamer interface {
+	Rename(src, dst *file.File) error
+}
+
+// Backends with local files that can keep the current content of a file
+// apart from later changes implement snapshotter. Handlers running in the
+// background need it, the path is no longer locked when they read the file.
+type snapshotter interface {
+	Snapshot(f *file.File) (string, func(), error)
+}
+
+const (
+	FileBackend   = "file"
+	MemoryBackend = "memory"
+	S3Backend     = "s3"
+)
+
+func newBackend(cfg StorageConfig) (Backend, error) {
+	switch cfg.Backend {
+	case "", FileBackend:
+		fs, err := file.NewFileService(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		switch cfg.Compression.Algorithm {
+		case "", file.Gzip, file.Zstd:
+		default:
+			return nil, fmt.Errorf("Unknown compression algorithm: %s", cfg.Compression.Algorithm)
+		}
+		fs.Compression = cfg.Compression
+		fs.Dedup = cfg.Dedup
+		if cfg.KeyFile != "" {
+			fs.Keys, err = file.LoadKeyring(cfg.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return fs, nil
+	case MemoryBackend:
+		return memory.NewBackend(), nil
+	case S3Backend:
+		return s3.NewBackend(cfg.S3)
+	default:
+		return nil, fmt.Errorf("Unknown storage backend: %s", cfg.Backend)
+	}
+}
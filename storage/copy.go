@@ -0,0 +1,103 @@
+package storage
+
+import "github.com/visheratin/storage/file"
+
+// applyPair is apply for operations with a source and a destination path.
+func (s *Storage) applyPair(src, dst string, evt EventType, fn func(*Event) error) error {
+	sf, err := s.Resolve(src)
+	if err != nil {
+		return err
+	}
+	df, err := s.Resolve(dst)
+	if err != nil {
+		return err
+	}
+	if sf.Path == df.Path {
+		return &file.InvalidPathError{Path: dst, Reason: "same as source"}
+	}
+	defer s.locks.LockPair(sf.Path, df.Path, evt == Move)()
+	err = s.retained(df.Path, evt)
+	if err != nil {
+		return err
+	}
+	if evt == Move {
+		err = s.retained(sf.Path, evt)
+		if err != nil {
+			return err
+		}
+	}
+	e := Event{File: &df, Source: &sf, Type: evt}
+	info, err := s.backend.Stat(&sf)
+	if err != nil {
+		return err
+	}
+	e.Size, e.Checksum, e.ETag = info.Size, info.Checksum, ETag(info)
+	err = s.stat(&e)
+	if err != nil {
+		return err
+	}
+	// Moves within a project do not change its usage. A replaced file is
+	// kept as a version, so its bytes are not freed.
+	if evt == Copy || project(sf.Path) != project(df.Path) {
+		prev := e.PrevSize
+		if s.Config.Versioning {
+			prev = 0
+		}
+		err = s.usage.check(df.Path, e.Size, prev, e.Existed)
+		if err != nil {
+			return err
+		}
+	}
+	err = fn(&e)
+	if err != nil {
+		return err
+	}
+	return s.trigger(e)
+}
+
+// Copy copies the file at src to dst, replacing the file at dst.
+func (s *Storage) Copy(src, dst string) error {
+	return s.applyPair(src, dst, Copy, func(e *Event) error {
+		if s.Config.Versioning {
+			err := s.archive(e.File)
+			if err != nil {
+				return err
+			}
+		}
+		err := s.copyFile(e.Source, e.File)
+		if err != nil {
+			return err
+		}
+		if s.Config.Versioning {
+			e.Version, err = s.currentVersion(e.File)
+		}
+		return err
+	})
+}
+
+// Move moves the file at src to dst, replacing the file at dst. Backends
+// that cannot rename files copy them and delete the source.
+func (s *Storage) Move(src, dst string) error {
+	return s.applyPair(src, dst, Move, func(e *Event) error {
+		if s.Config.Versioning {
+			for _, f := range []*file.File{e.File, e.Source} {
+				err := s.archive(f)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err := s.moveFile(e.Source, e.File)
+		if err != nil {
+			return err
+		}
+		if s.Config.Versioning {
+			e.Version, err = s.currentVersion(e.File)
+			if err != nil {
+				return err
+			}
+			_, err = s.markDeleted(e.Source)
+		}
+		return err
+	})
+}
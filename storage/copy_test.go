@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/memory"
+)
+
+func TestCopyAndMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := file.NewFileService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Compression = file.Compression{Algorithm: file.Gzip}
+
+	backends := map[string]Backend{"file": fs, "memory": memory.NewBackend()}
+	for name, b := range backends {
+		s := NewStorageWithBackend(StorageConfig{}, b)
+		var events []Event
+		for _, et := range []EventType{Save, Copy, Move} {
+			s.On(et, func(e Event) error {
+				events = append(events, e)
+				return nil
+			})
+		}
+		content := strings.Repeat("netcdf ", 100)
+		err := s.Save("a/src.nc", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := s.Stat("a/src.nc")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Copy("a/src.nc", "b/copy.nc")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		err = s.Move("a/src.nc", "b/moved.nc")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(events) != 3 {
+			t.Fatalf("%s: %d events", name, len(events))
+		}
+		for i, want := range []struct {
+			typ      EventType
+			src, dst string
+		}{{Copy, "a/src.nc", "b/copy.nc"}, {Move, "a/src.nc", "b/moved.nc"}} {
+			e := events[i+1]
+			if e.Type != want.typ || e.Source.Path != want.src || e.File.Path != want.dst {
+				t.Errorf("%s: event %d is %s %s -> %s", name, i+1, e.Type, e.Source.Path, e.File.Path)
+			}
+		}
+
+		_, err = s.Stat("a/src.nc")
+		if !errors.Is(err, file.ErrNotFound) {
+			t.Errorf("%s: source still exists after Move: %v", name, err)
+		}
+		for _, p := range []string{"b/copy.nc", "b/moved.nc"} {
+			pi, err := s.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pi.Checksum != info.Checksum || pi.Size != info.Size {
+				t.Errorf("%s: %s has %+v, want %+v", name, p, pi, info)
+			}
+			buf := &bytes.Buffer{}
+			err = s.Read(p, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != content {
+				t.Errorf("%s: %s has different content", name, p)
+			}
+		}
+
+		err = s.Move("b/copy.nc", "b/copy.nc")
+		if !errors.Is(err, file.ErrInvalidPath) {
+			t.Errorf("%s: Move onto itself returned %v", name, err)
+		}
+		err = s.Copy("missing.nc", "b/other.nc")
+		if !errors.Is(err, file.ErrNotFound) {
+			t.Errorf("%s: Copy of a missing file returned %v", name, err)
+		}
+	}
+}
+
+func TestMoveWithVersioning(t *testing.T) {
+	s := NewStorageWithBackend(StorageConfig{Versioning: true}, memory.NewBackend())
+	var moves []Event
+	s.On(Move, func(e Event) error {
+		moves = append(moves, e)
+		return nil
+	})
+	err := s.Save("a.nc", strings.NewReader("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Move("a.nc", "b.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != 1 || moves[0].Version == "" {
+		t.Fatalf("Move events %+v", moves)
+	}
+	vs, err := s.Versions("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 || !vs[1].Deleted {
+		t.Errorf("versions of the moved file are %+v", vs)
+	}
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"errors"
+	"log"
+
+	"github.com/visheratin/storage/file"
+)
+
+type rewrapper interface {
+	Rewrap(f *file.File) (bool, error)
+}
+
+// RotateKeys wraps the data keys of all encrypted files, including archived
+// versions and trashed files, with the active master key. It returns the
+// number of files that were rewrapped.
+func (s *Storage) RotateKeys() (int, error) {
+	rw, ok := s.backend.(rewrapper)
+	if !ok {
+		return 0, errors.New("backend does not support encryption")
+	}
+	infos, err := s.backend.List("")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, info := range infos {
+		changed, err := s.rewrap(rw, info.Path)
+		if err != nil {
+			return n, err
+		}
+		if changed {
+			log.Printf("Rewrapped data key of %s", info.Path)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *Storage) rewrap(rw rewrapper, path string) (bool, error) {
+	f, err := s.backend.Resolve(path)
+	if err != nil {
+		return false, err
+	}
+	defer s.locks.Lock(f.Path)()
+	changed, err := rw.Rewrap(&f)
+	if errors.Is(err, file.ErrNotFound) {
+		// Deleted since it was listed.
+		return false, nil
+	}
+	return changed, err
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// DispatchConfig makes Storage run event handlers in the background instead
+// of within the operation that fired the event. Handler errors then no
+// longer fail the operation, failing handlers are retried and finally
+// recorded as dead letters.
+type DispatchConfig struct {
+	// Workers is the number of events handled at the same time, zero runs
+	// the handlers synchronously.
+	Workers int
+	// Queue is the number of events that wait for a worker before
+	// operations block.
+	Queue int
+	// Retries is how often a failing handler is run again. The pause
+	// before the first retry is Backoff, it doubles for every further
+	// retry up to MaxBackoff.
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DeadLetter is an event a handler failed on with every retry. The
+// handlers registered after it did not run for the event.
+type DeadLetter struct {
+	Type     EventType `json:"type"`
+	Path     string    `json:"path"`
+	Source   string    `json:"source,omitempty"`
+	Version  string    `json:"version,omitempty"`
+	Handler  int       `json:"handler"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+type job struct {
+	e        Event
+	handlers []EventHandler
+	release  func()
+	paths    []string
+	// deps are closed when the previous events of the same paths have
+	// been handled, done when this one has.
+	deps []chan struct{}
+	done chan struct{}
+}
+
+type dispatcher struct {
+	cfg     DispatchConfig
+	jobs    chan *job
+	pending sync.WaitGroup
+	// queue is held while a job is registered and queued, so that jobs
+	// are queued in the order they depend on each other. Workers do not
+	// take it, a full queue cannot block them.
+	queue sync.Mutex
+	mu    sync.Mutex
+	last  map[string]chan struct{}
+	dead  []DeadLetter
+}
+
+func newDispatcher(cfg DispatchConfig) *dispatcher {
+	d := &dispatcher{
+		cfg:  cfg,
+		jobs: make(chan *job, cfg.Queue),
+		last: make(map[string]chan struct{}),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// enqueue queues the handlers of e, release is called once they are done.
+// Events are handled in the order they are queued per path, so enqueue
+// must be called while the paths of e are locked.
+func (d *dispatcher) enqueue(e Event, hs []EventHandler, release func()) {
+	j := &job{e: e, handlers: hs, release: release, done: make(chan struct{})}
+	j.paths = []string{e.File.Path}
+	if e.Source != nil {
+		j.paths = append(j.paths, e.Source.Path)
+	}
+	d.queue.Lock()
+	defer d.queue.Unlock()
+	d.mu.Lock()
+	for _, p := range j.paths {
+		if dep, ok := d.last[p]; ok {
+			j.deps = append(j.deps, dep)
+		}
+		d.last[p] = j.done
+	}
+	d.mu.Unlock()
+	d.pending.Add(1)
+	d.jobs <- j
+}
+
+// work handles queued events. Jobs are taken from the queue in order, so
+// the events a job waits for have been taken by other workers already.
+func (d *dispatcher) work() {
+	for j := range d.jobs {
+		for _, dep := range j.deps {
+			<-dep
+		}
+		d.handle(j)
+		j.release()
+		d.mu.Lock()
+		for _, p := range j.paths {
+			if d.last[p] == j.done {
+				delete(d.last, p)
+			}
+		}
+		d.mu.Unlock()
+		close(j.done)
+		d.pending.Done()
+	}
+}
+
+func (d *dispatcher) handle(j *job) {
+	for i, h := range j.handlers {
+		backoff := d.cfg.Backoff
+		attempts := 0
+		for {
+			attempts++
+			err := call(h, j.e)
+			if err == nil {
+				break
+			}
+			if attempts > d.cfg.Retries {
+				log.Printf("Handler %d failed for event %v after %d attempts: %v", i, j.e, attempts, err)
+				d.deadLetter(j.e, i, attempts, err)
+				return
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+			if d.cfg.MaxBackoff > 0 && backoff > d.cfg.MaxBackoff {
+				backoff = d.cfg.MaxBackoff
+			}
+		}
+	}
+}
+
+// call runs h, a panic is returned as an error so that a broken handler
+// does not take the server down.
+func call(h EventHandler, e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return h(e)
+}
+
+func (d *dispatcher) deadLetter(e Event, handler, attempts int, err error) {
+	dl := DeadLetter{
+		Type:     e.Type,
+		Path:     e.File.Path,
+		Version:  e.Version,
+		Handler:  handler,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Time:     time.Now().UTC(),
+	}
+	if e.Source != nil {
+		dl.Source = e.Source.Path
+	}
+	d.mu.Lock()
+	d.dead = append(d.dead, dl)
+	d.mu.Unlock()
+}
+
+// Flush waits until the handlers of all events fired so far are done. It
+// returns right away when handlers run synchronously.
+func (s *Storage) Flush() {
+	if s.dispatcher != nil {
+		s.dispatcher.pending.Wait()
+	}
+}
+
+// DeadLetters returns the events handlers failed on, oldest first.
+func (s *Storage) DeadLetters() []DeadLetter {
+	dls := []DeadLetter{}
+	if s.dispatcher == nil {
+		return dls
+	}
+	d := s.dispatcher
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append(dls, d.dead...)
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/memory"
+)
+
+func TestAsyncDispatch(t *testing.T) {
+	s := NewStorageWithBackend(StorageConfig{Dispatch: DispatchConfig{
+		Workers: 4,
+		Queue:   8,
+		Retries: 2,
+		Backoff: time.Millisecond,
+	}}, memory.NewBackend())
+
+	var mu sync.Mutex
+	seen := make(map[string][]string)
+	attempts := make(map[string]int)
+	s.On(Save, func(e Event) error {
+		mu.Lock()
+		attempts[e.File.Path]++
+		n := attempts[e.File.Path]
+		mu.Unlock()
+		switch {
+		case e.File.Path == "bad.nc":
+			return errors.New("cannot parse")
+		case e.File.Path == "flaky.nc" && n == 1:
+			return errors.New("database is locked")
+		}
+		b, err := ioutil.ReadFile(e.File.FullPath)
+		if err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		seen[e.File.Path] = append(seen[e.File.Path], string(b))
+		mu.Unlock()
+		return nil
+	})
+	var moved []string
+	s.On(Move, func(e Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		moved = append(moved, strings.Join(seen[e.Source.Path], ","))
+		return nil
+	})
+
+	for i := 0; i < 10; i++ {
+		for _, p := range []string{"a.nc", "b.nc"} {
+			err := s.Save(p, strings.NewReader(fmt.Sprint(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := s.Move("a.nc", "c.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"bad.nc", "flaky.nc"} {
+		err = s.Save(p, strings.NewReader("x"))
+		if err != nil {
+			t.Errorf("Save of %s returned %v", p, err)
+		}
+	}
+	s.Flush()
+
+	want := "0,1,2,3,4,5,6,7,8,9"
+	for _, p := range []string{"a.nc", "b.nc"} {
+		if got := strings.Join(seen[p], ","); got != want {
+			t.Errorf("events of %s handled as %s", p, got)
+		}
+	}
+	if len(moved) != 1 || moved[0] != want {
+		t.Errorf("Move was handled before the saves: %v", moved)
+	}
+	if len(seen["flaky.nc"]) != 1 {
+		t.Error("failing handler was not retried")
+	}
+	dls := s.DeadLetters()
+	if len(dls) != 1 || dls[0].Path != "bad.nc" || dls[0].Attempts != 3 || dls[0].Error != "cannot parse" {
+		t.Errorf("dead letters are %+v", dls)
+	}
+}
+
+func TestAsyncDispatchSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, dedup := range []bool{false, true} {
+		s, err := NewStorage(StorageConfig{
+			Dir:        filepath.Join(dir, fmt.Sprint(dedup)),
+			Dedup:      dedup,
+			Versioning: true,
+			Dispatch:   DispatchConfig{Workers: 1, Queue: 8},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gate := make(chan struct{})
+		var mu sync.Mutex
+		var seen []string
+		s.On(Save, func(e Event) error {
+			<-gate
+			b, err := ioutil.ReadFile(e.File.FullPath)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(b)
+			if hex.EncodeToString(sum[:]) != e.Checksum {
+				return fmt.Errorf("read %q for %s", b, e.Version)
+			}
+			mu.Lock()
+			seen = append(seen, string(b))
+			mu.Unlock()
+			return nil
+		})
+
+		// Handled only after all of them are done.
+		for _, c := range []string{"one", "two"} {
+			err = s.Save("a.nc", strings.NewReader(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = s.Delete("a.nc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		close(gate)
+		s.Flush()
+
+		if dls := s.DeadLetters(); len(dls) != 0 {
+			t.Errorf("dedup %v: dead letters %+v", dedup, dls)
+		}
+		if strings.Join(seen, ",") != "one,two" {
+			t.Errorf("dedup %v: handlers read %v", dedup, seen)
+		}
+		fis, _ := ioutil.ReadDir(s.Config.Dir)
+		for _, fi := range fis {
+			if file.IsReserved(fi.Name()) && fi.Name() != ".blobs" {
+				t.Errorf("dedup %v: snapshot %s left", dedup, fi.Name())
+			}
+		}
+	}
+}
+
+func TestAsyncDispatchRecoversPanics(t *testing.T) {
+	s := NewStorageWithBackend(StorageConfig{Dispatch: DispatchConfig{
+		Workers: 1,
+		Queue:   1,
+	}}, memory.NewBackend())
+	s.On(Save, func(e Event) error {
+		var m map[string]int
+		m[e.File.Path]++
+		return nil
+	})
+	err := s.Save("a.nc", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Flush()
+	dls := s.DeadLetters()
+	if len(dls) != 1 || !strings.Contains(dls[0].Error, "panicked") {
+		t.Errorf("dead letters are %+v", dls)
+	}
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"io"
+	"strings"
+
+	"github.com/visheratin/storage/file"
+)
+
+// Top level directories in the backend that hold Storage's own data.
+const (
+	versionsDir  = ".versions"
+	trashDir     = ".trash"
+	retentionDir = ".retention"
+	uploadsDir   = ".uploads"
+)
+
+var internalDirs = []string{versionsDir, trashDir, retentionDir, uploadsDir}
+
+func isInternal(path string) bool {
+	top := strings.SplitN(path, "/", 2)[0]
+	for _, d := range internalDirs {
+		if top == d {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFile copies the content of src into dst within the backend.
+func (s *Storage) copyFile(src, dst *file.File) error {
+	if c, ok := s.backend.(copier); ok {
+		return c.Copy(src, dst)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.backend.Read(src, pw))
+	}()
+	err := s.backend.Save(dst, pr)
+	pr.CloseWithError(err)
+	return err
+}
+
+// moveFile moves the content of src to dst within the backend.
+func (s *Storage) moveFile(src, dst *file.File) error {
+	if r, ok := s.backend.(renamer); ok {
+		return r.Rename(src, dst)
+	}
+	err := s.copyFile(src, dst)
+	if err != nil {
+		return err
+	}
+	return s.backend.Delete(src)
+}
@@ -0,0 +1,86 @@
+package storage
+
+import "sync"
+
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// lockManager hands out reader/writer locks per path. Entries are reference
+// counted and dropped once nobody holds or waits for them.
+type lockManager struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		locks: make(map[string]*pathLock),
+	}
+}
+
+func (m *lockManager) acquire(path string) *pathLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.locks[path]
+	if !ok {
+		l = &pathLock{}
+		m.locks[path] = l
+	}
+	l.refs++
+	return l
+}
+
+func (m *lockManager) release(path string, l *pathLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(m.locks, path)
+	}
+}
+
+// Lock locks path for writing and returns the function that unlocks it.
+func (m *lockManager) Lock(path string) func() {
+	l := m.acquire(path)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.release(path, l)
+	}
+}
+
+// RLock locks path for reading and returns the function that unlocks it.
+func (m *lockManager) RLock(path string) func() {
+	l := m.acquire(path)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		m.release(path, l)
+	}
+}
+
+// LockPair locks dst for writing and src for reading, or for writing when
+// exclusive is set. The paths are always locked in the same order, so that
+// operations on overlapping pairs cannot deadlock.
+func (m *lockManager) LockPair(src, dst string, exclusive bool) func() {
+	lockSrc := func() func() {
+		if exclusive {
+			return m.Lock(src)
+		}
+		return m.RLock(src)
+	}
+	var first, second func()
+	if src < dst {
+		first = lockSrc()
+		second = m.Lock(dst)
+	} else {
+		first = m.Lock(dst)
+		second = lockSrc()
+	}
+	return func() {
+		second()
+		first()
+	}
+}
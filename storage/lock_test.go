@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/visheratin/storage/file"
+)
+
+func TestConcurrentOperationsOnOnePath(t *testing.T) {
+	s := newMemoryStorage()
+	contents := map[string]bool{"aaaa": true, "bbbb": true}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			s.Save("a.nc", strings.NewReader("aaaa"))
+		}()
+		go func() {
+			defer wg.Done()
+			s.Save("a.nc", strings.NewReader("bbbb"))
+		}()
+		go func() {
+			defer wg.Done()
+			buf := new(bytes.Buffer)
+			err := s.Read("a.nc", buf)
+			if err == nil && !contents[buf.String()] {
+				t.Errorf("Read returned mixed content %q", buf.String())
+			}
+			if err != nil && !errors.Is(err, file.ErrNotFound) {
+				t.Error(err)
+			}
+		}()
+		if i%5 == 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Delete("a.nc")
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestSaveHandlerSeesOwnWrite(t *testing.T) {
+	s := newMemoryStorage()
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	s.On(Save, func(e Event) error {
+		// Give concurrent saves a chance to overwrite the file.
+		time.Sleep(time.Millisecond)
+		buf := new(bytes.Buffer)
+		err := s.backend.Read(e.File, buf)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		seen[buf.String()]++
+		mu.Unlock()
+		return nil
+	})
+
+	contents := []string{"aaaa", "bbbb", "cccc", "dddd", "eeee", "ffff"}
+	var wg sync.WaitGroup
+	for _, c := range contents {
+		wg.Add(1)
+		go func(c string) {
+			defer wg.Done()
+			err := s.Save("a.nc", strings.NewReader(c))
+			if err != nil {
+				t.Error(err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	for _, c := range contents {
+		if seen[c] != 1 {
+			t.Errorf("Save handlers saw %q %d times, want once", c, seen[c])
+		}
+	}
+}
+
+func TestConcurrentHandlerRegistration(t *testing.T) {
+	s := newMemoryStorage()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.On(Save, func(e Event) error { return nil })
+		}()
+		go func() {
+			defer wg.Done()
+			s.Save("a.nc", strings.NewReader("data"))
+		}()
+	}
+	wg.Wait()
+	if len(s.handlers[Save]) != 10 {
+		t.Errorf("%d handlers registered, want 10", len(s.handlers[Save]))
+	}
+}
+
+func TestLockManagerDropsUnusedLocks(t *testing.T) {
+	m := newLockManager()
+	unlock := m.Lock("a")
+	runlock := m.RLock("b")
+	unlock()
+	runlock()
+	if len(m.locks) != 0 {
+		t.Errorf("%d locks left after unlocking", len(m.locks))
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/visheratin/storage/file"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// notify calls changed with the directory, relative to dir, of every change
+// inotify reports under dir until stop is closed. recursive is set when
+// the directories below it changed as well. Internal and hidden directories
+// are not watched, changes there are only found by the periodic scans.
+func notify(dir string, changed func(dir string, recursive bool), stop <-chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	in := &inotify{
+		fd:   fd,
+		f:    os.NewFile(uintptr(fd), "inotify"),
+		root: dir,
+		dirs: make(map[int32]string),
+	}
+	err = in.add(dir)
+	if err != nil {
+		in.f.Close()
+		return err
+	}
+	// Closing the file unblocks the read in run.
+	go func() {
+		<-stop
+		in.f.Close()
+	}()
+	go in.run(changed)
+	return nil
+}
+
+type inotify struct {
+	fd   int
+	f    *os.File
+	root string
+	dirs map[int32]string
+}
+
+// add watches dir and every directory below it.
+func (in *inotify) add(dir string) error {
+	return filepath.Walk(dir, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(in.root, fp)
+		if err != nil {
+			return err
+		}
+		if rel != "." && (isInternal(filepath.ToSlash(rel)) || strings.HasPrefix(fi.Name(), ".")) {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(in.fd, fp, inotifyMask)
+		if err != nil {
+			return err
+		}
+		in.dirs[int32(wd)] = fp
+		return nil
+	})
+}
+
+func (in *inotify) run(changed func(dir string, recursive bool)) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := in.f.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				changed("", true)
+				continue
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(in.dirs, ev.Wd)
+				continue
+			}
+			parent, ok := in.dirs[ev.Wd]
+			base := strings.TrimRight(string(name), "\x00")
+			if !ok || file.IsReserved(base) {
+				// Temporary files and sidecars written by Storage.
+				continue
+			}
+			rel, err := filepath.Rel(in.root, filepath.Join(parent, base))
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			if ev.Mask&syscall.IN_ISDIR == 0 {
+				changed(parentDir(rel), false)
+				continue
+			}
+			if isInternal(rel) || strings.HasPrefix(base, ".") {
+				continue
+			}
+			// Files created in a new directory before it is watched are
+			// found by scanning it.
+			if ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				in.add(filepath.Join(parent, base))
+			}
+			changed(rel, true)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import "errors"
+
+func notify(dir string, changed func(dir string, recursive bool), stop <-chan struct{}) error {
+	return errors.New("inotify is not available")
+}
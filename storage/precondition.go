@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/visheratin/storage/file"
+)
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Precondition restricts a write to a particular state of the existing
+// file. Both lists hold ETags of the file or "*" for any file.
+type Precondition struct {
+	// IfMatch requires the current file to have one of the ETags.
+	IfMatch []string
+	// IfNoneMatch requires the current file to have none of the ETags,
+	// with "*" the file must not exist at all.
+	IfNoneMatch []string
+}
+
+func (p Precondition) empty() bool {
+	return len(p.IfMatch) == 0 && len(p.IfNoneMatch) == 0
+}
+
+func matchAny(list []string, etag string) bool {
+	for _, c := range list {
+		if c == "*" || c == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// check verifies the precondition against the current content of f.
+func (s *Storage) check(f *file.File, p Precondition) error {
+	if p.empty() {
+		return nil
+	}
+	etag, err := s.etag(f)
+	exists := true
+	if errors.Is(err, file.ErrNotFound) {
+		exists = false
+	} else if err != nil {
+		return err
+	}
+
+	if len(p.IfMatch) > 0 && (!exists || !matchAny(p.IfMatch, etag)) {
+		return fmt.Errorf("%s: %w: If-Match", f.Path, ErrPreconditionFailed)
+	}
+	if len(p.IfNoneMatch) > 0 && exists && matchAny(p.IfNoneMatch, etag) {
+		return fmt.Errorf("%s: %w: If-None-Match", f.Path, ErrPreconditionFailed)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ErrTooLarge is returned for files that are larger than the whole byte
+// quota of their project.
+var ErrTooLarge = errors.New("file exceeds quota")
+
+// Quota limits the bytes and the number of files under a top level
+// directory, which is a project. Zero means no limit.
+type Quota struct {
+	Bytes int64 `json:"bytes,omitempty"`
+	Files int64 `json:"files,omitempty"`
+}
+
+// Usage of a project. Bytes include the old versions and trashed copies of
+// the project's files, Retained counts these alone.
+type Usage struct {
+	Bytes    int64 `json:"bytes"`
+	Files    int64 `json:"files"`
+	Retained int64 `json:"retained"`
+	Quota    Quota `json:"quota"`
+}
+
+// project returns the top level directory of path. Files in the root
+// belong to the project with the empty name.
+func project(path string) string {
+	i := strings.Index(path, "/")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// retainedOwner returns the path of the file a version or trashed copy at
+// path was taken of.
+func retainedOwner(path string) (string, bool) {
+	for _, d := range []string{versionsDir, trashDir} {
+		if !strings.HasPrefix(path, d+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(path, d+"/")
+		i := strings.LastIndex(rest, "/")
+		if i < 0 {
+			return "", false
+		}
+		return rest[:i], true
+	}
+	return "", false
+}
+
+// usageTracker keeps the usage of every project up to date from Storage's
+// events. Bytes and files of saves in progress are reserved in pending, so
+// that concurrent saves cannot exceed a quota together.
+type usageTracker struct {
+	mu           sync.Mutex
+	quotas       map[string]Quota
+	usage        map[string]Usage
+	pendingBytes map[string]int64
+	pendingFiles map[string]int64
+}
+
+func newUsageTracker(quotas map[string]Quota) *usageTracker {
+	return &usageTracker{
+		quotas:       quotas,
+		usage:        make(map[string]Usage),
+		pendingBytes: make(map[string]int64),
+		pendingFiles: make(map[string]int64),
+	}
+}
+
+// load counts the files already in the backend.
+func (t *usageTracker) load(b Backend) error {
+	infos, err := b.List("")
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, info := range infos {
+		if owner, ok := retainedOwner(info.Path); ok {
+			t.addRetained(project(owner), info.Size)
+			continue
+		}
+		if isInternal(info.Path) {
+			continue
+		}
+		t.add(project(info.Path), info.Size, 1)
+	}
+	return nil
+}
+
+// retain charges bytes kept as a version or in the trash for the file at
+// path to its project, negative bytes free them again.
+func (t *usageTracker) retain(path string, bytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addRetained(project(path), bytes)
+}
+
+func (t *usageTracker) addRetained(p string, bytes int64) {
+	u := t.usage[p]
+	u.Bytes += bytes
+	u.Retained += bytes
+	t.usage[p] = u
+}
+
+func (t *usageTracker) add(p string, bytes, files int64) {
+	u := t.usage[p]
+	u.Bytes += bytes
+	u.Files += files
+	t.usage[p] = u
+}
+
+func (t *usageTracker) update(e Event) {
+	var prev, existed int64
+	if e.Existed {
+		prev, existed = e.PrevSize, 1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := project(e.File.Path)
+	switch e.Type {
+	case Save, Copy, Move:
+		t.add(p, e.Size-prev, 1-existed)
+	case Delete:
+		t.add(p, -prev, -existed)
+	}
+	if e.Type == Move {
+		t.add(project(e.Source.Path), -e.Size, -1)
+	}
+}
+
+// exceeded checks whether adding bytes and files to project p would break
+// its quota. t.mu must be held.
+func (t *usageTracker) exceeded(p string, bytes, files int64) error {
+	q := t.quotas[p]
+	u := t.usage[p]
+	if q.Bytes > 0 && bytes > 0 && u.Bytes+t.pendingBytes[p]+bytes > q.Bytes {
+		return fmt.Errorf("%w: project %q is limited to %d bytes", ErrQuotaExceeded, p, q.Bytes)
+	}
+	if q.Files > 0 && files > 0 && u.Files+t.pendingFiles[p]+files > q.Files {
+		return fmt.Errorf("%w: project %q is limited to %d files", ErrQuotaExceeded, p, q.Files)
+	}
+	return nil
+}
+
+// check verifies that a file of size bytes can be written to path, where
+// it replaces a file of prevSize bytes if existed is set.
+func (t *usageTracker) check(path string, size, prevSize int64, existed bool) error {
+	p := project(path)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if q := t.quotas[p]; q.Bytes > 0 && size > q.Bytes {
+		return fmt.Errorf("%w: project %q is limited to %d bytes", ErrTooLarge, p, q.Bytes)
+	}
+	files := int64(1)
+	if existed {
+		files = 0
+	} else {
+		prevSize = 0
+	}
+	return t.exceeded(p, size-prevSize, files)
+}
+
+// reserve wraps r for a save to path that fails as soon as the quota of the
+// project is exceeded. The bytes of the file it replaces are available to
+// the save. The returned function releases the reservation.
+func (t *usageTracker) reserve(path string, r io.Reader, prevSize int64, existed bool) (io.Reader, func(), error) {
+	p := project(path)
+	q, ok := t.quotas[p]
+	if !ok {
+		return r, func() {}, nil
+	}
+	qr := &quotaReader{t: t, p: p, r: r, limit: q.Bytes}
+	if existed {
+		qr.credit = prevSize
+	} else {
+		t.mu.Lock()
+		err := t.exceeded(p, 0, 1)
+		if err == nil {
+			t.pendingFiles[p]++
+			qr.file = true
+		}
+		t.mu.Unlock()
+		if err != nil {
+			return nil, func() {}, err
+		}
+	}
+	return qr, qr.release, nil
+}
+
+// limit wraps r, the content of a chunk of an upload to path, so that it
+// fails once the chunk and the staged bytes of the other chunks could not
+// be saved within the quota of the project. The file the upload replaces
+// is given by prevSize and existed.
+func (t *usageTracker) limit(path string, r io.Reader, staged, prevSize int64, existed bool) io.Reader {
+	if _, ok := t.quotas[project(path)]; !ok {
+		return r
+	}
+	return &chunkReader{t: t, path: path, r: r, size: staged, prevSize: prevSize, existed: existed}
+}
+
+type chunkReader struct {
+	t        *usageTracker
+	path     string
+	r        io.Reader
+	size     int64
+	prevSize int64
+	existed  bool
+}
+
+func (cr *chunkReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.size += int64(n)
+	if n > 0 {
+		qerr := cr.t.check(cr.path, cr.size, cr.prevSize, cr.existed)
+		if qerr != nil {
+			return n, qerr
+		}
+	}
+	return n, err
+}
+
+type quotaReader struct {
+	t       *usageTracker
+	p       string
+	r       io.Reader
+	limit   int64
+	credit  int64
+	read    int64
+	charged int64
+	file    bool
+}
+
+func (qr *quotaReader) Read(b []byte) (int, error) {
+	n, err := qr.r.Read(b)
+	qr.read += int64(n)
+	if qr.limit == 0 {
+		return n, err
+	}
+	if qr.read > qr.limit {
+		return n, fmt.Errorf("%w: project %q is limited to %d bytes", ErrTooLarge, qr.p, qr.limit)
+	}
+	charge := qr.read - qr.credit - qr.charged
+	if charge <= 0 {
+		return n, err
+	}
+	qr.t.mu.Lock()
+	defer qr.t.mu.Unlock()
+	qerr := qr.t.exceeded(qr.p, charge, 0)
+	if qerr != nil {
+		return n, qerr
+	}
+	qr.t.pendingBytes[qr.p] += charge
+	qr.charged += charge
+	return n, err
+}
+
+func (qr *quotaReader) release() {
+	qr.t.mu.Lock()
+	defer qr.t.mu.Unlock()
+	qr.t.pendingBytes[qr.p] -= qr.charged
+	qr.charged = 0
+	if qr.file {
+		qr.t.pendingFiles[qr.p]--
+		qr.file = false
+	}
+}
+
+// Usage returns the usage of every project that has files or a quota.
+func (s *Storage) Usage() map[string]Usage {
+	t := s.usage
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make(map[string]Usage)
+	for p, u := range t.usage {
+		if u.Files != 0 || u.Bytes != 0 {
+			res[p] = u
+		}
+	}
+	for p, q := range t.quotas {
+		u := res[p]
+		u.Quota = q
+		res[p] = u
+	}
+	return res
+}
+
+// trackUsage counts the existing files, from then on the tracker is
+// updated with every event before the handlers run.
+func (s *Storage) trackUsage() {
+	err := s.usage.load(s.backend)
+	if err != nil {
+		log.Printf("Failed to compute storage usage: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/visheratin/storage/memory"
+)
+
+func TestQuotas(t *testing.T) {
+	b := memory.NewBackend()
+	old := NewStorageWithBackend(StorageConfig{}, b)
+	err := old.Save("cmip/existing.nc", strings.NewReader(strings.Repeat("x", 40)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorageWithBackend(StorageConfig{Quotas: map[string]Quota{
+		"cmip": {Bytes: 100, Files: 3},
+	}}, b)
+	if u := s.Usage()["cmip"]; u.Bytes != 40 || u.Files != 1 || u.Quota.Bytes != 100 {
+		t.Fatalf("usage after start is %+v", u)
+	}
+
+	err = s.Save("cmip/huge.nc", strings.NewReader(strings.Repeat("x", 101)))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Save larger than the quota returned %v", err)
+	}
+	err = s.Save("cmip/a.nc", strings.NewReader(strings.Repeat("x", 50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Save("cmip/b.nc", strings.NewReader(strings.Repeat("x", 20)))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Save over the byte quota returned %v", err)
+	}
+	// Replacing a file may use its bytes.
+	err = s.Save("cmip/a.nc", strings.NewReader(strings.Repeat("x", 60)))
+	if err != nil {
+		t.Errorf("Save replacing a file returned %v", err)
+	}
+	err = s.Save("cmip/c.nc", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Save("cmip/d.nc", strings.NewReader(""))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Save over the file quota returned %v", err)
+	}
+	err = s.Copy("cmip/a.nc", "cmip/copy.nc")
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Copy over the quota returned %v", err)
+	}
+	// Other projects are not limited.
+	err = s.Move("cmip/a.nc", "obs/a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Delete("cmip/existing.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage := s.Usage()
+	if u := usage["cmip"]; u.Bytes != 0 || u.Files != 1 {
+		t.Errorf("cmip usage is %+v", u)
+	}
+	if u := usage["obs"]; u.Bytes != 60 || u.Files != 1 {
+		t.Errorf("obs usage is %+v", u)
+	}
+}
+
+func TestUsageOfVersionsAndTrash(t *testing.T) {
+	b := memory.NewBackend()
+	cfg := StorageConfig{
+		Versioning:     true,
+		TrashRetention: time.Hour,
+		Quotas:         map[string]Quota{"p": {Bytes: 25}},
+	}
+	s := NewStorageWithBackend(cfg, b)
+	check := func(step string, bytes, files, retained int64) {
+		t.Helper()
+		u := s.Usage()["p"]
+		if u.Bytes != bytes || u.Files != files || u.Retained != retained {
+			t.Errorf("%s: usage is %+v", step, u)
+		}
+	}
+
+	for _, c := range []string{"12345", "1234567"} {
+		err := s.Save("p/a.nc", strings.NewReader(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("replace", 12, 1, 5)
+	err := s.Delete("p/a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One copy as a version, one in the trash.
+	check("delete", 19, 0, 19)
+	err = s.Undelete("p/a.nc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("undelete", 19, 1, 12)
+
+	s = NewStorageWithBackend(cfg, b)
+	check("load", 19, 1, 12)
+	err = s.Save("p/b.nc", strings.NewReader("1234567"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Save beyond the quota with retained bytes returned %v", err)
+	}
+}
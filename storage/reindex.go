@@ -0,0 +1,28 @@
+package storage
+
+// Reindex fires a Save event for the current content of path without
+// changing it, so that handlers rebuild what they derive from the file.
+func (s *Storage) Reindex(path string) error {
+	f, err := s.Resolve(path)
+	if err != nil {
+		return err
+	}
+	defer s.locks.Lock(f.Path)()
+	info, err := s.backend.Stat(&f)
+	if err != nil {
+		return err
+	}
+	e := Event{
+		File:     &f,
+		Type:     Save,
+		Size:     info.Size,
+		PrevSize: info.Size,
+		Existed:  true,
+		Checksum: info.Checksum,
+		ETag:     ETag(info),
+	}
+	if s.Config.Versioning {
+		e.Version = versionID(info)
+	}
+	return s.triggerLocal(e)
+}
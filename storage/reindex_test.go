@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReindex(t *testing.T) {
+	s := newMemoryStorage()
+	err := s.Save("a.nc", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	s.On(Save, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	err = s.Reindex("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Checksum == "" || events[0].Size != 7 || events[0].File.FullPath == "" {
+		t.Fatalf("events are %+v", events)
+	}
+	if u := s.Usage()[""]; u.Files != 1 || u.Bytes != 7 {
+		t.Errorf("usage after Reindex is %+v", u)
+	}
+	if s.Reindex("missing.nc") == nil {
+		t.Error("Reindex of a missing file succeeded")
+	}
+}
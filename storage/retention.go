@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/visheratin/storage/file"
+)
+
+var ErrLocked = errors.New("locked by retention")
+
+// Retention locks and their audit trail are kept in the backend, so they
+// survive restarts and move with the data. Every audit entry is a file of
+// its own under retentionAudit, named so that they sort chronologically.
+const (
+	retentionLocks = retentionDir + "/locks.json"
+	retentionAudit = retentionDir + "/audit/"
+)
+
+// Retention makes a file, or every file under a prefix, immutable until a
+// point in time. Locks without Until are legal holds that last until they
+// are released.
+type Retention struct {
+	Path      string     `json:"path"`
+	Prefix    bool       `json:"prefix,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+	Created   time.Time  `json:"created"`
+	CreatedBy string     `json:"createdBy,omitempty"`
+}
+
+func (r Retention) active(now time.Time) bool {
+	return r.Until == nil || now.Before(*r.Until)
+}
+
+func (r Retention) covers(path string) bool {
+	if r.Prefix {
+		return strings.HasPrefix(path, r.Path+"/")
+	}
+	return path == r.Path
+}
+
+func (r Retention) String() string {
+	p := r.Path
+	if r.Prefix {
+		p += "/"
+	}
+	if r.Until == nil {
+		return p + " indefinitely"
+	}
+	return p + " until " + r.Until.Format(time.RFC3339)
+}
+
+// AuditEntry records a change of the retention locks or an operation they
+// refused.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Path   string    `json:"path"`
+	Actor  string    `json:"actor,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// retention holds the locks in memory once they are loaded from the
+// backend. seq numbers the audit entries written by this process.
+type retention struct {
+	mu     sync.Mutex
+	loaded bool
+	locks  []Retention
+	seq    uint64
+}
+
+// loadRetention reads the locks on first use. s.retention.mu must be held.
+func (s *Storage) loadRetention() error {
+	r := s.retention
+	if r.loaded {
+		return nil
+	}
+	f, err := s.backend.Resolve(retentionLocks)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	err = s.backend.Read(&f, buf)
+	if errors.Is(err, file.ErrNotFound) {
+		r.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(buf.Bytes(), &r.locks)
+	if err != nil {
+		return err
+	}
+	for i, l := range r.locks {
+		// Written as the zero time by earlier versions.
+		if l.Until != nil && l.Until.IsZero() {
+			r.locks[i].Until = nil
+		}
+	}
+	r.loaded = true
+	return nil
+}
+
+func (s *Storage) saveRetention(locks []Retention) error {
+	js, err := json.Marshal(locks)
+	if err != nil {
+		return err
+	}
+	f, err := s.backend.Resolve(retentionLocks)
+	if err != nil {
+		return err
+	}
+	err = s.backend.Save(&f, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	s.retention.locks = locks
+	return nil
+}
+
+// audit adds an entry to the audit trail.
+func (s *Storage) audit(e AuditEntry) {
+	e.Time = time.Now().UTC()
+	log.Printf("Retention audit: %s %s %s %s", e.Action, e.Path, e.Actor, e.Detail)
+	err := s.writeAudit(e)
+	if err != nil {
+		log.Printf("Failed to write retention audit entry: %v", err)
+	}
+}
+
+func (s *Storage) writeAudit(e AuditEntry) error {
+	seq := atomic.AddUint64(&s.retention.seq, 1)
+	name := fmt.Sprintf("%s-%010d.json", e.Time.Format(trashTimeFormat), seq)
+	f, err := s.backend.Resolve(retentionAudit + name)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.backend.Save(&f, bytes.NewReader(js))
+}
+
+// retained fails with ErrLocked when an active lock covers path.
+func (s *Storage) retained(path string, op EventType) error {
+	l, ok, err := s.lockOn(path)
+	if err != nil || !ok {
+		return err
+	}
+	s.audit(AuditEntry{Action: "deny " + strings.ToLower(string(op)), Path: path, Detail: l.String()})
+	return fmt.Errorf("%s: %w %s", path, ErrLocked, l)
+}
+
+// lockOn returns an active lock covering path.
+func (s *Storage) lockOn(path string) (Retention, bool, error) {
+	r := s.retention
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := s.loadRetention()
+	if err != nil {
+		return Retention{}, false, err
+	}
+	now := time.Now()
+	for _, l := range r.locks {
+		if l.active(now) && l.covers(path) {
+			return l, true, nil
+		}
+	}
+	return Retention{}, false, nil
+}
+
+// Retain locks path until the given time, or indefinitely if until is
+// zero. A path ending with a slash locks every file under it. An existing
+// lock on the same path can only be extended.
+func (s *Storage) Retain(path string, until time.Time, actor string) (Retention, error) {
+	prefix := strings.HasSuffix(path, "/")
+	p, err := file.Clean(path)
+	if err != nil {
+		return Retention{}, err
+	}
+	if isInternal(p) {
+		return Retention{}, &file.InvalidPathError{Path: path, Reason: "reserved name"}
+	}
+	now := time.Now().UTC()
+	nl := Retention{Path: p, Prefix: prefix, Created: now, CreatedBy: actor}
+	if !until.IsZero() {
+		if !until.After(now) {
+			return Retention{}, &file.InvalidPathError{Path: path, Reason: "retention must end in the future"}
+		}
+		until = until.UTC()
+		nl.Until = &until
+	}
+
+	r := s.retention
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err = s.loadRetention()
+	if err != nil {
+		return Retention{}, err
+	}
+	var locks []Retention
+	for _, l := range r.locks {
+		if !l.active(now) {
+			continue
+		}
+		if l.Path == nl.Path && l.Prefix == nl.Prefix {
+			if l.Until == nil || (nl.Until != nil && nl.Until.Before(*l.Until)) {
+				return Retention{}, fmt.Errorf("%s: %w %s, it cannot be shortened", path, ErrLocked, l)
+			}
+			continue
+		}
+		locks = append(locks, l)
+	}
+	locks = append(locks, nl)
+	err = s.saveRetention(locks)
+	if err != nil {
+		return Retention{}, err
+	}
+	s.audit(AuditEntry{Action: "retain", Path: nl.Path, Actor: actor, Detail: nl.String()})
+	return nl, nil
+}
+
+// Release removes the legal hold on path. Locks with an end date cannot be
+// released, they expire.
+func (s *Storage) Release(path, actor string) error {
+	prefix := strings.HasSuffix(path, "/")
+	p, err := file.Clean(path)
+	if err != nil {
+		return err
+	}
+	r := s.retention
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err = s.loadRetention()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var locks []Retention
+	var released *Retention
+	for i, l := range r.locks {
+		if !l.active(now) {
+			continue
+		}
+		if l.Path == p && l.Prefix == prefix {
+			if l.Until != nil {
+				return fmt.Errorf("%s: %w %s, it cannot be released", path, ErrLocked, l)
+			}
+			released = &r.locks[i]
+			continue
+		}
+		locks = append(locks, l)
+	}
+	if released == nil {
+		return fmt.Errorf("%s: retention %w", path, file.ErrNotFound)
+	}
+	err = s.saveRetention(locks)
+	if err != nil {
+		return err
+	}
+	s.audit(AuditEntry{Action: "release", Path: p, Actor: actor, Detail: released.String()})
+	return nil
+}
+
+// Retentions lists the active locks ordered by path.
+func (s *Storage) Retentions() ([]Retention, error) {
+	r := s.retention
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := s.loadRetention()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	locks := []Retention{}
+	for _, l := range r.locks {
+		if l.active(now) {
+			locks = append(locks, l)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Path < locks[j].Path
+	})
+	return locks, nil
+}
+
+// RetentionAudit returns the audit trail, oldest entries first.
+func (s *Storage) RetentionAudit() ([]AuditEntry, error) {
+	infos, err := s.backend.List(retentionAudit)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+	es := []AuditEntry{}
+	for _, info := range infos {
+		f, err := s.backend.Resolve(info.Path)
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		err = s.backend.Read(&f, buf)
+		if errors.Is(err, file.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e AuditEntry
+		err = json.Unmarshal(buf.Bytes(), &e)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/visheratin/storage/memory"
+)
+
+func TestRetention(t *testing.T) {
+	b := memory.NewBackend()
+	s := NewStorageWithBackend(StorageConfig{}, b)
+	for _, p := range []string{"exp1/a.nc", "exp1/b.nc", "exp2/c.nc"} {
+		err := s.Save(p, strings.NewReader("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	until := time.Now().Add(time.Hour)
+	_, err := s.Retain("exp1/a.nc", until, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Retain("exp2/", time.Time{}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Retain("exp1/a.nc", until.Add(-time.Minute), "admin")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("shortening a retention returned %v", err)
+	}
+	_, err = s.Retain("exp1/b.nc", time.Now().Add(-time.Hour), "admin")
+	if err == nil {
+		t.Error("retention in the past was accepted")
+	}
+
+	err = s.Save("exp1/a.nc", strings.NewReader("new"))
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Save of a retained file returned %v", err)
+	}
+	err = s.Delete("exp2/c.nc")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Delete under a retained prefix returned %v", err)
+	}
+	err = s.Move("exp1/a.nc", "exp1/moved.nc")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Move of a retained file returned %v", err)
+	}
+	err = s.Copy("exp1/a.nc", "exp2/copy.nc")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Copy into a retained prefix returned %v", err)
+	}
+	err = s.Copy("exp1/a.nc", "exp1/copy.nc")
+	if err != nil {
+		t.Errorf("Copy of a retained file returned %v", err)
+	}
+	err = s.Delete("exp1/b.nc")
+	if err != nil {
+		t.Errorf("Delete of a file without retention returned %v", err)
+	}
+
+	err = s.Release("exp1/a.nc", "admin")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Release of a dated retention returned %v", err)
+	}
+
+	// Locks are loaded from the backend by a new Storage.
+	s = NewStorageWithBackend(StorageConfig{}, b)
+	ls, err := s.Retentions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 2 || ls[0].Path != "exp1/a.nc" || !ls[1].Prefix || ls[1].CreatedBy != "admin" {
+		t.Fatalf("retentions are %+v", ls)
+	}
+	err = s.Release("exp2/", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Delete("exp2/c.nc")
+	if err != nil {
+		t.Errorf("Delete after the release returned %v", err)
+	}
+
+	es, err := s.RetentionAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range es {
+		actions = append(actions, e.Action)
+	}
+	got := strings.Join(actions, ",")
+	want := "retain,retain,deny save,deny delete,deny move,deny copy,release"
+	if got != want {
+		t.Errorf("audit actions are %s, want %s", got, want)
+	}
+}
+
+func TestIndefiniteHoldEncoding(t *testing.T) {
+	b := memory.NewBackend()
+	s := NewStorageWithBackend(StorageConfig{}, b)
+	l, err := s.Retain("a.nc", time.Time{}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(js), "until") {
+		t.Errorf("indefinite hold encoded as %s", js)
+	}
+
+	// Earlier versions wrote the zero time.
+	f, err := b.Resolve(retentionLocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := `[{"path":"a.nc","until":"0001-01-01T00:00:00Z","created":"2020-01-01T00:00:00Z"}]`
+	err = b.Save(&f, strings.NewReader(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = NewStorageWithBackend(StorageConfig{}, b)
+	err = s.Delete("a.nc")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Delete under a legacy hold returned %v", err)
+	}
+	err = s.Release("a.nc", "admin")
+	if err != nil {
+		t.Errorf("Release of a legacy hold returned %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/visheratin/storage/file"
+)
+
+type ScrubConfig struct {
+	// Interval is the pause between two passes over the store.
+	Interval time.Duration
+	// BytesPerSecond limits how fast files are read, zero means no limit.
+	BytesPerSecond int64
+}
+
+type ScrubProblem struct {
+	Path  string    `json:"path"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+type ScrubReport struct {
+	Started    time.Time      `json:"started"`
+	Finished   time.Time      `json:"finished,omitempty"`
+	Checked    int            `json:"checked"`
+	Unverified int            `json:"unverified"`
+	Bytes      int64          `json:"bytes"`
+	Problems   []ScrubProblem `json:"problems"`
+}
+
+// Scrubber periodically re-reads every stored file, compares its checksum
+// with the recorded one and fires a Corrupt event for every mismatch.
+type Scrubber struct {
+	Config ScrubConfig
+	// Check is an optional extra check run for every file, e.g. against
+	// the metadata catalog. Its errors are reported like corruption.
+	Check func(file.Info) error
+
+	storage *Storage
+	mu      sync.Mutex
+	current *ScrubReport
+	last    *ScrubReport
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewScrubber(s *Storage, cfg ScrubConfig) *Scrubber {
+	return &Scrubber{
+		Config:  cfg,
+		storage: s,
+	}
+}
+
+// Start runs passes in the background until Stop is called.
+func (sc *Scrubber) Start() {
+	sc.stop = make(chan struct{})
+	sc.done = make(chan struct{})
+	go func() {
+		defer close(sc.done)
+		for {
+			sc.Scrub()
+			select {
+			case <-sc.stop:
+				return
+			case <-time.After(sc.Config.Interval):
+			}
+		}
+	}()
+}
+
+func (sc *Scrubber) Stop() {
+	close(sc.stop)
+	<-sc.done
+}
+
+// Report returns the pass in progress, or the last finished one.
+func (sc *Scrubber) Report() ScrubReport {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	r := sc.current
+	if r == nil {
+		r = sc.last
+	}
+	if r == nil {
+		return ScrubReport{}
+	}
+	res := *r
+	res.Problems = append([]ScrubProblem{}, r.Problems...)
+	return res
+}
+
+// Scrub makes a single pass over the store.
+func (sc *Scrubber) Scrub() ScrubReport {
+	sc.mu.Lock()
+	sc.current = &ScrubReport{Started: time.Now(), Problems: []ScrubProblem{}}
+	sc.mu.Unlock()
+
+	infos, err := sc.storage.backend.List("")
+	if err != nil {
+		sc.problem(file.Info{}, err)
+	}
+	tw := &throttledWriter{rate: sc.Config.BytesPerSecond, start: time.Now()}
+	for _, info := range infos {
+		select {
+		case <-sc.stop:
+			sc.finish()
+			return sc.Report()
+		default:
+		}
+		if project(info.Path) == uploadsDir {
+			// Chunks have no checksums.
+			continue
+		}
+		sc.scrubFile(info.Path, tw)
+	}
+	sc.finish()
+	return sc.Report()
+}
+
+func (sc *Scrubber) finish() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.current.Finished = time.Now()
+	log.Printf("Scrub finished: %d files checked, %d problems", sc.current.Checked, len(sc.current.Problems))
+	sc.last = sc.current
+	sc.current = nil
+}
+
+func (sc *Scrubber) scrubFile(path string, tw *throttledWriter) {
+	f, err := sc.storage.backend.Resolve(path)
+	if err != nil {
+		sc.problem(file.Info{Path: path}, err)
+		return
+	}
+	unlock := sc.storage.locks.RLock(f.Path)
+	info, err := sc.storage.backend.Stat(&f)
+	unlock()
+	if errors.Is(err, file.ErrNotFound) {
+		// Deleted since the listing.
+		return
+	}
+	stated := err == nil
+	if err == nil && info.Checksum != "" {
+		// The read is throttled and can take long, so it runs without
+		// the lock and is checked against the file afterwards.
+		h := sha256.New()
+		tw.w = h
+		err = sc.storage.backend.Read(&f, tw)
+		sum := hex.EncodeToString(h.Sum(nil))
+		if err == nil && sum != info.Checksum {
+			err = fmt.Errorf("%s: %w: recorded %s, computed %s", f.Path, file.ErrChecksumMismatch, info.Checksum, sum)
+		}
+	}
+
+	sc.mu.Lock()
+	sc.current.Checked++
+	sc.current.Bytes += info.Size
+	if info.Checksum == "" {
+		sc.current.Unverified++
+	}
+	sc.mu.Unlock()
+
+	if err == nil && sc.Check != nil {
+		err = sc.Check(info)
+	}
+	if err == nil {
+		return
+	}
+	// Events of a path are queued while it is locked, so that background
+	// handlers see them in order.
+	defer sc.storage.locks.RLock(f.Path)()
+	if stated && sc.changed(&f, info) {
+		// Replaced or deleted while it was read, the next pass checks
+		// the new content.
+		return
+	}
+	sc.problem(info, err)
+	terr := sc.storage.trigger(Event{File: &f, Type: Corrupt, Err: err})
+	if terr != nil {
+		log.Printf("Corrupt handlers for %s failed: %v", f.Path, terr)
+	}
+}
+
+// changed reports whether f no longer is the file info describes. The
+// path of f must be locked.
+func (sc *Scrubber) changed(f *file.File, info file.Info) bool {
+	now, err := sc.storage.backend.Stat(f)
+	if err != nil {
+		return true
+	}
+	return now.Size != info.Size || !now.ModTime.Equal(info.ModTime) || now.Checksum != info.Checksum
+}
+
+func (sc *Scrubber) problem(info file.Info, err error) {
+	log.Printf("Scrub problem with %s: %v", info.Path, err)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.current.Problems = append(sc.current.Problems, ScrubProblem{info.Path, err.Error(), time.Now()})
+}
+
+// throttledWriter sleeps after writes so that the average rate since start
+// stays below rate bytes per second.
+type throttledWriter struct {
+	w     io.Writer
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	tw.n += int64(n)
+	if tw.rate > 0 {
+		expected := time.Duration(float64(tw.n) / float64(tw.rate) * float64(time.Second))
+		if elapsed := time.Since(tw.start); elapsed < expected {
+			time.Sleep(expected - elapsed)
+		}
+	}
+	return n, err
+}
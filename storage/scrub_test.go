@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/memory"
+)
+
+func TestScrubberDetectsBitRot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrub-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewStorage(StorageConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a.nc", "b/c.nc"} {
+		err = s.Save(p, strings.NewReader("content of "+p))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var corrupt []string
+	s.On(Corrupt, func(e Event) error {
+		if !errors.Is(e.Err, file.ErrChecksumMismatch) {
+			t.Errorf("Corrupt event with unexpected error %v", e.Err)
+		}
+		corrupt = append(corrupt, e.File.Path)
+		return nil
+	})
+
+	// Flip a byte without changing size or modification time.
+	f, _ := s.Resolve("b/c.nc")
+	fi, err := os.Stat(f.FullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(f.FullPath, []byte("content of b/c.nC"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(f.FullPath, fi.ModTime(), fi.ModTime())
+
+	sc := NewScrubber(s, ScrubConfig{})
+	r := sc.Scrub()
+	if r.Checked != 2 || len(r.Problems) != 1 || r.Problems[0].Path != "b/c.nc" {
+		t.Errorf("Scrub returned %+v", r)
+	}
+	if len(corrupt) != 1 || corrupt[0] != "b/c.nc" {
+		t.Errorf("Corrupt events fired for %v", corrupt)
+	}
+}
+
+// replacingBackend saves new content for a file when the scrubber starts
+// reading it, like an upload that arrives during the read.
+type replacingBackend struct {
+	*memory.Backend
+	s    *Storage
+	path string
+}
+
+func (b *replacingBackend) Read(f *file.File, w io.Writer) error {
+	if f.Path == b.path {
+		b.path = ""
+		err := b.s.Save(f.Path, strings.NewReader("new content"))
+		if err != nil {
+			return err
+		}
+	}
+	return b.Backend.Read(f, w)
+}
+
+func TestScrubIgnoresFileReplacedDuringRead(t *testing.T) {
+	b := &replacingBackend{Backend: memory.NewBackend()}
+	s := NewStorageWithBackend(StorageConfig{}, b)
+	b.s = s
+	err := s.Save("a.nc", strings.NewReader("old content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.On(Corrupt, func(e Event) error {
+		t.Errorf("Corrupt event for %s: %v", e.File.Path, e.Err)
+		return nil
+	})
+	b.path = "a.nc"
+
+	r := NewScrubber(s, ScrubConfig{}).Scrub()
+	if r.Checked != 1 || len(r.Problems) != 0 {
+		t.Errorf("Scrub returned %+v", r)
+	}
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/visheratin/storage/file"
+)
+
+const DefaultListLimit = 1000
+
+func contentType(p string) string {
+	ext := path.Ext(p)
+	if ext == ".nc" || ext == ".nc4" {
+		return "application/x-netcdf"
+	}
+	t := mime.TypeByExtension(ext)
+	if t == "" {
+		return "application/octet-stream"
+	}
+	return t
+}
+
+// Stat returns information about the file at path. The checksum is the
+// hex encoded SHA-256 of the content, empty for files stored before
+// checksums were recorded. Stat does not read the content to compute it.
+func (s *Storage) Stat(path string) (file.Info, error) {
+	f, err := s.Resolve(path)
+	if err != nil {
+		return file.Info{}, err
+	}
+	defer s.locks.RLock(f.Path)()
+	info, err := s.backend.Stat(&f)
+	if err != nil {
+		return file.Info{}, err
+	}
+	info.ContentType = contentType(info.Path)
+	return info, nil
+}
+
+// ETag identifies the content of the file described by info. It is the
+// checksum where one is recorded, otherwise it is made of the size and
+// modification time.
+func ETag(info file.Info) string {
+	if info.Checksum != "" {
+		return info.Checksum
+	}
+	return fmt.Sprintf("%x-%x", info.Size, info.ModTime.UnixNano())
+}
+
+// etag returns the ETag of the current content of f.
+func (s *Storage) etag(f *file.File) (string, error) {
+	info, err := s.backend.Stat(f)
+	if err != nil {
+		return "", err
+	}
+	return ETag(info), nil
+}
+
+func (s *Storage) compute(f *file.File) (string, error) {
+	h := sha256.New()
+	err := s.backend.Read(f, h)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify recomputes the checksum of the file at path and compares it with
+// the recorded one. Files without a recorded checksum pass.
+func (s *Storage) Verify(path string) error {
+	f, err := s.Resolve(path)
+	if err != nil {
+		return err
+	}
+	defer s.locks.RLock(f.Path)()
+	info, err := s.backend.Stat(&f)
+	if err != nil {
+		return err
+	}
+	if info.Checksum == "" {
+		return nil
+	}
+	sum, err := s.compute(&f)
+	if err != nil {
+		return err
+	}
+	if sum != info.Checksum {
+		return fmt.Errorf("%s: %w: recorded %s, computed %s", f.Path, file.ErrChecksumMismatch, info.Checksum, sum)
+	}
+	return nil
+}
+
+// List returns up to limit files under prefix ordered by path, starting
+// after cursor. The returned cursor is empty when there are no more files.
+func (s *Storage) List(prefix, cursor string, limit int) ([]file.Info, string, error) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	infos, err := s.listPage(strings.TrimLeft(prefix, "/"), cursor, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(infos) > limit {
+		infos = infos[:limit]
+		next = infos[limit-1].Path
+	}
+	for i := range infos {
+		infos[i].ContentType = contentType(infos[i].Path)
+	}
+	return infos, next, nil
+}
+
+// listPage returns up to limit files under prefix after the path after,
+// leaving out the internal directories.
+func (s *Storage) listPage(prefix, after string, limit int) ([]file.Info, error) {
+	var infos []file.Info
+	for len(infos) < limit {
+		n := limit - len(infos)
+		page, err := s.backend.ListPage(prefix, after, n)
+		if err != nil {
+			return nil, err
+		}
+		skipped := false
+		for _, info := range page {
+			after = info.Path
+			if isInternal(info.Path) {
+				// Continue behind everything in the internal directory.
+				after = strings.SplitN(info.Path, "/", 2)[0] + "/\U0010FFFF"
+				skipped = true
+				break
+			}
+			infos = append(infos, info)
+		}
+		if !skipped && len(page) < n {
+			break
+		}
+	}
+	return infos, nil
+}
@@ -1,48 +1,129 @@
 package storage
 
 import (
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/s3"
 )
 
 type EventType string
 
 const (
-	Save   EventType = "SAVE"
-	Delete EventType = "DELETE"
-	Read   EventType = "READ"
+	Save    EventType = "SAVE"
+	Delete  EventType = "DELETE"
+	Read    EventType = "READ"
+	Corrupt EventType = "CORRUPT"
+	// Purge is fired when a trashed file is removed for good.
+	Purge EventType = "PURGE"
+	// Copy and Move events carry the new path in File and the old one in
+	// Source.
+	Copy EventType = "COPY"
+	Move EventType = "MOVE"
 )
 
 type Event struct {
-	File *file.File
-	Type EventType
+	File   *file.File
+	Source *file.File
+	Type   EventType
+	// Version is set when versioning is enabled. It is the new current
+	// version for Save events and the delete marker for Delete events.
+	Version string
+	// Soft is set for Delete events that moved the file into the trash.
+	Soft bool
+	// Err describes the problem for Corrupt events.
+	Err error
+	// Size is the size of the file after Save, Copy and Move events.
+	// PrevSize is the size of the file at File before the operation if it
+	// Existed.
+	Size     int64
+	PrevSize int64
+	Existed  bool
+	// Checksum is the SHA-256 checksum of the content after Save, Copy and
+	// Move events if the backend records it. ETag is set for these events
+	// as well, it also tells content without a checksum apart.
+	Checksum string
+	ETag     string
 }
 
 type Storage struct {
-	Config      StorageConfig
-	fileService *file.FileService
+	Config  StorageConfig
+	backend Backend
+	locks   *lockManager
+	// uploadLocks are held per resumable upload id.
+	uploadLocks *lockManager
+	usage       *usageTracker
+	watcher     *Watcher
+	dispatcher  *dispatcher
+	retention   *retention
+	mu          sync.RWMutex
 	handlers    map[EventType][]EventHandler
 }
 
 type StorageConfig struct {
-	Dir string
+	Backend string
+	Dir     string
+	S3      s3.Config
+	// Compression applies to the file backend only.
+	Compression file.Compression
+	// KeyFile enables encryption at rest in the file backend with the
+	// master keys from this file.
+	KeyFile string
+	// Dedup stores identical content once in the file backend.
+	Dedup bool
+	// Versioning keeps the previous content on every Save and Delete.
+	Versioning bool
+	// TrashRetention makes Delete move files into the trash, where they are
+	// kept for this long. Zero deletes files right away.
+	TrashRetention time.Duration
+	// UploadDir is where chunks of resumable uploads are staged. If empty
+	// it is a directory within the one of the file backend, or within the
+	// system temporary directory for the other backends.
+	UploadDir string
+	// UploadTTL is how long an upload may go without receiving a chunk
+	// before ExpireUploads discards it. Zero keeps uploads forever.
+	UploadTTL time.Duration
+	// Quotas limit the projects, the top level directories, named by the
+	// keys.
+	Quotas map[string]Quota
+	// Dispatch runs event handlers in the background when it has workers.
+	Dispatch DispatchConfig
 }
 
 func NewStorage(cfg StorageConfig) (*Storage, error) {
-	fs, err := file.NewFileService(cfg.Dir)
+	b, err := newBackend(cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &Storage{
+	return NewStorageWithBackend(cfg, b), nil
+}
+
+func NewStorageWithBackend(cfg StorageConfig, b Backend) *Storage {
+	s := &Storage{
 		Config:      cfg,
-		fileService: fs,
+		backend:     b,
+		locks:       newLockManager(),
+		uploadLocks: newLockManager(),
+		usage:       newUsageTracker(cfg.Quotas),
+		retention:   &retention{},
 		handlers:    make(map[EventType][]EventHandler),
-	}, nil
+	}
+	if cfg.Dispatch.Workers > 0 {
+		s.dispatcher = newDispatcher(cfg.Dispatch)
+	}
+	s.trackUsage()
+	return s
 }
 
 func (s *Storage) On(evt EventType, h EventHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	hs, ok := s.handlers[evt]
 
 	if !ok {
@@ -56,15 +137,107 @@ func (s *Storage) On(evt EventType, h EventHandler) {
 
 type EventHandler func(Event) error
 
-func (s *Storage) Resolve(path string) file.File {
-	return s.fileService.Resolve(path)
+// Resolve resolves a user supplied path. Directories Storage uses for its
+// own bookkeeping cannot be addressed.
+func (s *Storage) Resolve(path string) (file.File, error) {
+	f, err := s.backend.Resolve(path)
+	if err != nil {
+		return f, err
+	}
+	if isInternal(f.Path) {
+		return file.File{}, &file.InvalidPathError{Path: path, Reason: "reserved name"}
+	}
+	return f, nil
+}
+
+// Local returns the file at path with FullPath pointing to a copy on the
+// local disk, which is what the NetCDF library needs. For backends without
+// local files the copy is temporary and is removed by the release function.
+// The path stays read locked until release is called.
+func (s *Storage) Local(path string) (file.File, func(), error) {
+	f, err := s.Resolve(path)
+	if err != nil {
+		return f, nil, err
+	}
+	unlock := s.locks.RLock(f.Path)
+	release, err := s.localize(&f)
+	if err != nil {
+		unlock()
+		return f, nil, err
+	}
+	return f, func() {
+		release()
+		unlock()
+	}, nil
 }
 
-func (s *Storage) trigger(e Event) (err error) {
+func (s *Storage) localize(f *file.File) (func(), error) {
+	if f.FullPath != "" {
+		return func() {}, nil
+	}
+	tmp, err := ioutil.TempFile("", "storage-")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+	err = s.backend.Read(f, tmp)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	f.FullPath = tmp.Name()
+	return func() {
+		os.Remove(tmp.Name())
+	}, nil
+}
+
+func (s *Storage) trigger(e Event) error {
+	return s.triggerWith(e, func() {})
+}
+
+// triggerLocal triggers the handlers with a local copy of e.File that is
+// kept until they are done. Handlers running in the background get a
+// snapshot, the file can change once the path is unlocked.
+func (s *Storage) triggerLocal(e Event) error {
+	f := *e.File
+	e.File = &f
+	var release func()
+	var err error
+	sn, ok := s.backend.(snapshotter)
+	switch {
+	case s.dispatcher == nil:
+		release, err = s.localize(&f)
+	case ok && f.FullPath != "":
+		f.FullPath, release, err = sn.Snapshot(&f)
+	default:
+		f.FullPath = ""
+		release, err = s.localize(&f)
+	}
+	if err != nil {
+		return err
+	}
+	return s.triggerWith(e, release)
+}
+
+// triggerWith runs the handlers of e, or queues them when they run in the
+// background, and calls release once they are done.
+func (s *Storage) triggerWith(e Event, release func()) (err error) {
 	log.Printf("Triggering handlers for event: %v", e)
+	s.usage.update(e)
+	s.mu.RLock()
 	hs := s.handlers[e.Type]
+	w := s.watcher
+	s.mu.RUnlock()
+	if w != nil {
+		w.update(e)
+	}
+	if s.dispatcher != nil {
+		s.dispatcher.enqueue(e, hs, release)
+		return nil
+	}
+	defer release()
 	for _, h := range hs {
-		err = h(e)
+		err = call(h, e)
 		if err != nil {
 			return err
 		}
@@ -72,31 +245,159 @@ func (s *Storage) trigger(e Event) (err error) {
 	return
 }
 
-func (s *Storage) apply(path string, fn func(*file.File) error, evt EventType) error {
-	f := s.Resolve(path)
-	fp := &f
-	err := fn(fp)
+// apply runs fn on the file at path and triggers the handlers for evt with
+// the event fn has filled in. Saves and deletes hold the path's write lock
+// and reads its read lock until the handlers return, so handlers must not
+// call back into Storage for the same path. Handlers dispatched in the
+// background run after the locks are released.
+func (s *Storage) apply(path string, evt EventType, fn func(*Event) error) error {
+	f, err := s.Resolve(path)
 	if err != nil {
-		return nil
+		return err
+	}
+	if evt == Read {
+		defer s.locks.RLock(f.Path)()
+	} else {
+		defer s.locks.Lock(f.Path)()
+	}
+	e := Event{File: &f, Type: evt}
+	if evt != Read {
+		err = s.retained(f.Path, evt)
+		if err != nil {
+			return err
+		}
+		err = s.stat(&e)
+		if err != nil {
+			return err
+		}
+	}
+	err = fn(&e)
+	if err != nil {
+		return err
+	}
+	if evt == Save {
+		info, err := s.backend.Stat(e.File)
+		if err != nil {
+			return err
+		}
+		e.Size, e.Checksum, e.ETag = info.Size, info.Checksum, ETag(info)
+		// Save handlers parse the stored file, so they need it on disk.
+		return s.triggerLocal(e)
 	}
-	e := Event{fp, evt}
 	return s.trigger(e)
 }
 
+// stat records the size of the file an event is about to change.
+func (s *Storage) stat(e *Event) error {
+	info, err := s.backend.Stat(e.File)
+	if errors.Is(err, file.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	e.PrevSize, e.Existed = info.Size, true
+	return nil
+}
+
 func (s *Storage) Save(path string, r io.Reader) error {
-	return s.apply(path, func(f *file.File) error {
-		return s.fileService.Save(f, r)
-	}, Save)
+	return s.SaveIf(path, r, Precondition{})
+}
+
+// SaveIf saves the file only if the existing file at path satisfies p.
+func (s *Storage) SaveIf(path string, r io.Reader, p Precondition) error {
+	// The quota reservation is held until the handlers have counted the
+	// saved file.
+	release := func() {}
+	defer func() {
+		release()
+	}()
+	return s.apply(path, Save, func(e *Event) error {
+		err := s.check(e.File, p)
+		if err != nil {
+			return err
+		}
+		r, release, err = s.usage.reserve(e.File.Path, r, e.PrevSize, e.Existed)
+		if err != nil {
+			return err
+		}
+		if s.Config.Versioning {
+			err = s.archive(e.File)
+			if err != nil {
+				return err
+			}
+		}
+		err = s.backend.Save(e.File, r)
+		if err != nil {
+			return err
+		}
+		if s.Config.Versioning {
+			e.Version, err = s.currentVersion(e.File)
+		}
+		return err
+	})
 }
 
 func (s *Storage) Delete(path string) error {
-	return s.apply(path, func(f *file.File) error {
-		return s.fileService.Delete(f)
-	}, Delete)
+	return s.apply(path, Delete, func(e *Event) error {
+		if s.Config.Versioning {
+			err := s.archive(e.File)
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		if s.Config.TrashRetention > 0 {
+			err = s.trash(e.File, e.PrevSize)
+			e.Soft = true
+		} else {
+			err = s.backend.Delete(e.File)
+		}
+		if err != nil {
+			return err
+		}
+		if s.Config.Versioning {
+			e.Version, err = s.markDeleted(e.File)
+		}
+		return err
+	})
 }
 
 func (s *Storage) Read(path string, w io.Writer) error {
-	return s.apply(path, func(f *file.File) error {
-		return s.fileService.Read(f, w)
-	}, Read)
+	return s.apply(path, Read, func(e *Event) error {
+		return s.backend.Read(e.File, w)
+	})
+}
+
+// ReadRange writes length bytes of the file at path starting at offset.
+func (s *Storage) ReadRange(path string, w io.Writer, offset, length int64) error {
+	return s.apply(path, Read, func(e *Event) error {
+		return s.backend.ReadRange(e.File, w, offset, length)
+	})
+}
+
+// ReadWithInfo passes information about the file at path to open, then
+// writes the range open asks for to the writer it returns. Both happen
+// under one read lock, so the content matches the information. Nothing
+// is read when open returns a nil writer.
+func (s *Storage) ReadWithInfo(path string, open func(file.Info) (w io.Writer, offset, length int64, err error)) error {
+	f, err := s.Resolve(path)
+	if err != nil {
+		return err
+	}
+	defer s.locks.RLock(f.Path)()
+	info, err := s.backend.Stat(&f)
+	if err != nil {
+		return err
+	}
+	info.ContentType = contentType(info.Path)
+	w, offset, length, err := open(info)
+	if err != nil || w == nil {
+		return err
+	}
+	err = s.backend.ReadRange(&f, w, offset, length)
+	if err != nil {
+		return err
+	}
+	return s.trigger(Event{File: &f, Type: Read})
 }
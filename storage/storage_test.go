@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/memory"
+)
+
+func newMemoryStorage() *Storage {
+	return NewStorageWithBackend(StorageConfig{Backend: MemoryBackend}, memory.NewBackend())
+}
+
+func TestSaveEventHasLocalFile(t *testing.T) {
+	s := newMemoryStorage()
+	var content string
+	s.On(Save, func(e Event) error {
+		b, err := ioutil.ReadFile(e.File.FullPath)
+		content = string(b)
+		return err
+	})
+
+	err := s.Save("a/b.nc", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "data" {
+		t.Errorf("Save handler read %q", content)
+	}
+
+	buf := new(bytes.Buffer)
+	err = s.Read("a/b.nc", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "data" {
+		t.Errorf("Read returned %q", buf.String())
+	}
+}
+
+func TestFailedOperationReturnsErrorWithoutEvent(t *testing.T) {
+	s := newMemoryStorage()
+	fired := false
+	s.On(Delete, func(e Event) error {
+		fired = true
+		return nil
+	})
+
+	err := s.Delete("missing.nc")
+	if !errors.Is(err, file.ErrNotFound) {
+		t.Errorf("Delete of missing file returned %v", err)
+	}
+	if fired {
+		t.Error("Delete event fired for failed delete")
+	}
+
+	err = s.Save("../escape.nc", strings.NewReader("data"))
+	if !errors.Is(err, file.ErrInvalidPath) {
+		t.Errorf("Save of invalid path returned %v", err)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	s := newMemoryStorage()
+	for _, p := range []string{"b/2.nc", "a/1.nc", "b/1.nc", "b/3.nc", "c.nc"} {
+		err := s.Save(p, strings.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var paths []string
+	cursor := ""
+	for i := 0; ; i++ {
+		infos, next, err := s.List("b/", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			paths = append(paths, info.Path)
+		}
+		if next == "" {
+			break
+		}
+		if i > 3 {
+			t.Fatal("List did not terminate")
+		}
+		cursor = next
+	}
+	if strings.Join(paths, ",") != "b/1.nc,b/2.nc,b/3.nc" {
+		t.Errorf("List returned %v", paths)
+	}
+
+	info, err := s.Stat("c.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 4 || info.ContentType != "application/x-netcdf" || len(info.Checksum) != 64 {
+		t.Errorf("Stat returned %+v", info)
+	}
+}
+
+func TestSaveIf(t *testing.T) {
+	s := newMemoryStorage()
+	create := Precondition{IfNoneMatch: []string{"*"}}
+
+	err := s.SaveIf("a.nc", strings.NewReader("v1"), create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SaveIf("a.nc", strings.NewReader("v2"), create)
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("create-only Save over existing file returned %v", err)
+	}
+
+	info, err := s.Stat("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SaveIf("a.nc", strings.NewReader("v2"), Precondition{IfMatch: []string{info.Checksum}})
+	if err != nil {
+		t.Errorf("Save with matching checksum failed: %v", err)
+	}
+	err = s.SaveIf("a.nc", strings.NewReader("v3"), Precondition{IfMatch: []string{info.Checksum}})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("Save with stale checksum returned %v", err)
+	}
+	err = s.SaveIf("b.nc", strings.NewReader("v1"), Precondition{IfMatch: []string{"*"}})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("Save with If-Match * on missing file returned %v", err)
+	}
+}
+
+func TestCorruptedUploadRejected(t *testing.T) {
+	s := newMemoryStorage()
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	err := s.Save("a.nc", file.VerifyingReader(strings.NewReader("hellO"), sum))
+	if !errors.Is(err, file.ErrChecksumMismatch) {
+		t.Errorf("Save of corrupted upload returned %v", err)
+	}
+	_, err = s.Stat("a.nc")
+	if !errors.Is(err, file.ErrNotFound) {
+		t.Errorf("corrupted upload was stored: %v", err)
+	}
+
+	err = s.Save("a.nc", file.VerifyingReader(strings.NewReader("hello"), sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Verify("a.nc")
+	if err != nil {
+		t.Errorf("Verify of intact file returned %v", err)
+	}
+}
+
+func TestETagOfFileWithoutChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStorage(StorageConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "a.nc"), []byte("legacy"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Checksum != "" {
+		t.Errorf("Stat computed checksum %s", info.Checksum)
+	}
+	etag := ETag(info)
+	if etag == "" {
+		t.Fatal("file without checksum has no ETag")
+	}
+	err = s.SaveIf("a.nc", strings.NewReader("v2"), Precondition{IfMatch: []string{etag}})
+	if err != nil {
+		t.Errorf("Save with matching ETag failed: %v", err)
+	}
+	err = s.SaveIf("a.nc", strings.NewReader("v3"), Precondition{IfMatch: []string{etag}})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("Save with stale ETag returned %v", err)
+	}
+}
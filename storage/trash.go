@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/visheratin/storage/file"
+)
+
+// Trashed files are kept in the backend under .trash/<path>/<id> where id
+// is the time of deletion.
+const trashTimeFormat = "20060102T150405.000000000Z"
+
+type TrashEntry struct {
+	Path      string    `json:"path"`
+	ID        string    `json:"id"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deletedAt"`
+	Expires   time.Time `json:"expires"`
+}
+
+func trashPrefix(path string) string {
+	return trashDir + "/" + path + "/"
+}
+
+// trash moves the content of f, which has size bytes, into the trash.
+func (s *Storage) trash(f *file.File, size int64) error {
+	id := time.Now().UTC().Format(trashTimeFormat)
+	tf, err := s.backend.Resolve(trashPrefix(f.Path) + id)
+	if err != nil {
+		return err
+	}
+	err = s.moveFile(f, &tf)
+	if err != nil {
+		return err
+	}
+	s.usage.retain(f.Path, size)
+	return nil
+}
+
+// parseTrashPath splits the backend path of a trash entry.
+func (s *Storage) parseTrashPath(p string) (TrashEntry, bool) {
+	rest := strings.TrimPrefix(p, trashDir+"/")
+	i := strings.LastIndex(rest, "/")
+	if i < 0 {
+		return TrashEntry{}, false
+	}
+	t, err := time.Parse(trashTimeFormat, rest[i+1:])
+	if err != nil {
+		return TrashEntry{}, false
+	}
+	return TrashEntry{
+		Path:      rest[:i],
+		ID:        rest[i+1:],
+		DeletedAt: t,
+		Expires:   t.Add(s.Config.TrashRetention),
+	}, true
+}
+
+// Trash lists trashed files under prefix, most recently deleted first.
+func (s *Storage) Trash(prefix string) ([]TrashEntry, error) {
+	infos, err := s.backend.List(trashDir + "/" + strings.TrimLeft(prefix, "/"))
+	if err != nil {
+		return nil, err
+	}
+	es := []TrashEntry{}
+	for _, info := range infos {
+		e, ok := s.parseTrashPath(info.Path)
+		if !ok {
+			continue
+		}
+		e.Size = info.Size
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].DeletedAt.After(es[j].DeletedAt)
+	})
+	return es, nil
+}
+
+// Undelete restores a trashed file to its original path. With an empty id
+// the most recently deleted copy is restored. A file that has since been
+// saved at path is not overwritten.
+func (s *Storage) Undelete(path, id string) error {
+	return s.apply(path, Save, func(e *Event) error {
+		_, err := s.backend.Stat(e.File)
+		if err == nil {
+			return fmt.Errorf("%s: %w", e.File.Path, file.ErrExists)
+		}
+		if !errors.Is(err, file.ErrNotFound) {
+			return err
+		}
+		if id == "" {
+			es, err := s.Trash(e.File.Path + "/")
+			if err != nil {
+				return err
+			}
+			for _, te := range es {
+				if te.Path == e.File.Path {
+					id = te.ID
+					break
+				}
+			}
+			if id == "" {
+				return fmt.Errorf("%s: %w in trash", e.File.Path, file.ErrNotFound)
+			}
+		}
+		tf, err := s.backend.Resolve(trashPrefix(e.File.Path) + id)
+		if err != nil {
+			return err
+		}
+		info, err := s.backend.Stat(&tf)
+		if err != nil {
+			return err
+		}
+		err = s.moveFile(&tf, e.File)
+		if err != nil {
+			return err
+		}
+		s.usage.retain(e.File.Path, -info.Size)
+		if s.Config.Versioning {
+			e.Version, err = s.currentVersion(e.File)
+		}
+		return err
+	})
+}
+
+// Purge permanently removes trash entries older than the retention period
+// and fires a Purge event for each of them.
+func (s *Storage) Purge() (int, error) {
+	es, err := s.Trash("")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	now := time.Now()
+	for _, te := range es {
+		if te.Expires.After(now) {
+			continue
+		}
+		tf, err := s.backend.Resolve(trashPrefix(te.Path) + te.ID)
+		if err != nil {
+			return n, err
+		}
+		err = s.purge(te, &tf)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (s *Storage) purge(te TrashEntry, tf *file.File) error {
+	defer s.locks.Lock(te.Path)()
+	err := s.backend.Delete(tf)
+	if errors.Is(err, file.ErrNotFound) {
+		// Undeleted in the meantime.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.usage.retain(te.Path, -te.Size)
+	f := file.File{Path: te.Path}
+	return s.trigger(Event{File: &f, Type: Purge})
+}
+
+// RunPurge calls Purge every interval until stop is closed.
+func (s *Storage) RunPurge(interval time.Duration, stop <-chan struct{}) {
+	for {
+		n, err := s.Purge()
+		if err != nil {
+			log.Printf("Purging trash failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d files from trash", n)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/memory"
+)
+
+func TestTrash(t *testing.T) {
+	s := NewStorageWithBackend(StorageConfig{TrashRetention: time.Hour}, memory.NewBackend())
+	var events []Event
+	for _, et := range []EventType{Save, Delete, Purge} {
+		s.On(et, func(e Event) error {
+			events = append(events, e)
+			return nil
+		})
+	}
+
+	err := s.Save("a/b.nc", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Delete("a/b.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !events[1].Soft {
+		t.Error("Delete event is not marked as soft")
+	}
+	_, err = s.Stat("a/b.nc")
+	if !errors.Is(err, file.ErrNotFound) {
+		t.Errorf("deleted file still visible: %v", err)
+	}
+
+	es, err := s.Trash("a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 || es[0].Path != "a/b.nc" || es[0].Size != 4 {
+		t.Fatalf("Trash returned %+v", es)
+	}
+
+	n, err := s.Purge()
+	if err != nil || n != 0 {
+		t.Errorf("Purge removed %d unexpired entries: %v", n, err)
+	}
+
+	err = s.Undelete("a/b.nc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = s.Read("a/b.nc", buf)
+	if err != nil || buf.String() != "data" {
+		t.Errorf("Read after Undelete returned %q, %v", buf.String(), err)
+	}
+	es, _ = s.Trash("")
+	if len(es) != 0 {
+		t.Errorf("trash not empty after Undelete: %+v", es)
+	}
+
+	s.Config.TrashRetention = time.Nanosecond
+	err = s.Delete("a/b.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	n, err = s.Purge()
+	if err != nil || n != 1 {
+		t.Errorf("Purge removed %d expired entries: %v", n, err)
+	}
+	last := events[len(events)-1]
+	if last.Type != Purge || last.File.Path != "a/b.nc" {
+		t.Errorf("last event is %+v, want Purge", last)
+	}
+	err = s.Undelete("a/b.nc", "")
+	if !errors.Is(err, file.ErrNotFound) {
+		t.Errorf("Undelete after Purge returned %v", err)
+	}
+}
+
+func TestTrashRenamesFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStorage(StorageConfig{Dir: dir, TrashRetention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Save("a.nc", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.Stat(filepath.Join(dir, "a.nc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Delete("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := s.Trash("")
+	if err != nil || len(es) != 1 {
+		t.Fatalf("Trash returned %+v, %v", es, err)
+	}
+	trashed, err := os.Stat(filepath.Join(dir, trashDir, "a.nc", es[0].ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(saved, trashed) {
+		t.Error("trashed file was copied instead of renamed")
+	}
+
+	err = s.Undelete("a.nc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := os.Stat(filepath.Join(dir, "a.nc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(saved, restored) {
+		t.Error("undeleted file was copied instead of renamed")
+	}
+	info, err := s.Stat("a.nc")
+	if err != nil || info.Checksum == "" {
+		t.Errorf("Stat of undeleted file returned %+v, %v", info, err)
+	}
+}
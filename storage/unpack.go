@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/visheratin/storage/file"
+)
+
+// UnpackResult is the outcome of saving one file of an archive.
+type UnpackResult struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+	Err   error  `json:"-"`
+}
+
+// joinPath places the relative path name under prefix. Names climbing out
+// of the prefix are rejected.
+func joinPath(prefix, name string) (string, error) {
+	c, err := file.Clean(name)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(prefix, c), nil
+}
+
+// Unpack saves every regular file of the tar, gzip compressed tar or zip
+// archive read from r under prefix. The format is detected from the
+// content. Files that cannot be saved are reported in their result, the
+// returned error is set when the archive itself cannot be read.
+func (s *Storage) Unpack(prefix string, r io.Reader) ([]UnpackResult, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		return s.unpackZip(prefix, br)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		return s.unpackTar(prefix, gr)
+	}
+	return s.unpackTar(prefix, br)
+}
+
+// SaveEntry saves the file with the relative path name under prefix and
+// records the outcome.
+func (s *Storage) SaveEntry(prefix, name string, r io.Reader) UnpackResult {
+	res := UnpackResult{Path: name}
+	p, err := joinPath(prefix, name)
+	if err == nil {
+		res.Path = p
+		cr := &countingReader{r: r}
+		err = s.Save(p, cr)
+		res.Size = cr.n
+	}
+	if err != nil {
+		res.Err = err
+		res.Error = err.Error()
+	}
+	return res
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (s *Storage) unpackTar(prefix string, r io.Reader) ([]UnpackResult, error) {
+	var res []UnpackResult
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+		case tar.TypeReg:
+			res = append(res, s.SaveEntry(prefix, hdr.Name, tr))
+		default:
+			err := fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+			res = append(res, UnpackResult{Path: hdr.Name, Error: err.Error(), Err: err})
+		}
+	}
+}
+
+// unpackZip stages the archive in a temporary file since the zip directory
+// is at its end.
+func (s *Storage) unpackZip(prefix string, r io.Reader) ([]UnpackResult, error) {
+	tmp, err := ioutil.TempFile("", "storage-unpack-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, err
+	}
+	var res []UnpackResult
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			err := fmt.Errorf("unsupported entry mode %v", zf.Mode())
+			res = append(res, UnpackResult{Path: zf.Name, Error: err.Error(), Err: err})
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			res = append(res, UnpackResult{Path: zf.Name, Error: err.Error(), Err: err})
+			continue
+		}
+		res = append(res, s.SaveEntry(prefix, zf.Name, rc))
+		rc.Close()
+	}
+	return res, nil
+}
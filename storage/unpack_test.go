@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+var archiveFiles = []struct{ name, content string }{
+	{"a.nc", "first"},
+	{"sub/b.nc", "second"},
+	{"../escape.nc", "bad"},
+}
+
+func tarArchive(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, f := range archiveFiles {
+		err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f.content))
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUnpack(t *testing.T) {
+	tgz := &bytes.Buffer{}
+	gw := gzip.NewWriter(tgz)
+	gw.Write(tarArchive(t))
+	gw.Close()
+
+	zbuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zbuf)
+	for _, f := range archiveFiles {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(f.content))
+	}
+	zw.Close()
+
+	archives := map[string][]byte{
+		"tar":    tarArchive(t),
+		"tar.gz": tgz.Bytes(),
+		"zip":    zbuf.Bytes(),
+	}
+	for format, b := range archives {
+		s := newMemoryStorage()
+		saves := 0
+		s.On(Save, func(e Event) error {
+			saves++
+			return nil
+		})
+		res, err := s.Unpack("exp1", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if len(res) != 3 || saves != 2 {
+			t.Fatalf("%s: %d results and %d Save events", format, len(res), saves)
+		}
+		if res[1].Path != "exp1/sub/b.nc" || res[1].Size != 6 || res[1].Err != nil {
+			t.Errorf("%s: second result is %+v", format, res[1])
+		}
+		if res[2].Err == nil {
+			t.Errorf("%s: file outside of the prefix was saved", format)
+		}
+		buf := &bytes.Buffer{}
+		err = s.Read("exp1/a.nc", buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != "first" {
+			t.Errorf("%s: unpacked file is %q", format, buf.String())
+		}
+	}
+}
+
+func TestUnpackCorruptArchive(t *testing.T) {
+	s := newMemoryStorage()
+	b := tarArchive(t)
+	_, err := s.Unpack("exp1", bytes.NewReader(b[:700]))
+	if err == nil {
+		t.Error("truncated archive was unpacked without an error")
+	}
+}
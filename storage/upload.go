@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/visheratin/storage/file"
+)
+
+var ErrUploadNotFound = errors.New("upload not found")
+var ErrIncompleteUpload = errors.New("incomplete upload")
+
+// Chunks of resumable uploads are staged in UploadDir/<id>/<number> until
+// the upload is completed, the upload itself is described by
+// UploadDir/<id>/upload.json.
+const uploadInfoName = "upload.json"
+
+type Upload struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+	Chunks  []Chunk   `json:"chunks"`
+}
+
+// Chunk is a received part of an upload. Chunks are numbered from 1 and
+// assembled in order of their numbers.
+type Chunk struct {
+	Number int   `json:"number"`
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+func (s *Storage) uploadDir() string {
+	if s.Config.UploadDir != "" {
+		return s.Config.UploadDir
+	}
+	// On the same file system as the stored files, so that the system
+	// temporary directory does not have to hold large uploads.
+	if fs, ok := s.backend.(*file.FileService); ok {
+		return filepath.Join(fs.Dir, uploadsDir)
+	}
+	return filepath.Join(os.TempDir(), "storage-uploads")
+}
+
+// stagingDir returns the directory of upload id. Ids are generated by
+// InitiateUpload, anything else does not name an upload.
+func (s *Storage) stagingDir(id string) (string, error) {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 16 {
+		return "", fmt.Errorf("%s: %w", id, ErrUploadNotFound)
+	}
+	dir := filepath.Join(s.uploadDir(), id)
+	_, err = os.Stat(dir)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s: %w", id, ErrUploadNotFound)
+	}
+	return dir, err
+}
+
+// InitiateUpload starts a resumable upload of the file at path and returns
+// its id.
+func (s *Storage) InitiateUpload(path string) (Upload, error) {
+	f, err := s.Resolve(path)
+	if err != nil {
+		return Upload{}, err
+	}
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return Upload{}, err
+	}
+	u := Upload{ID: hex.EncodeToString(b), Path: f.Path, Created: time.Now().UTC()}
+	dir := filepath.Join(s.uploadDir(), u.ID)
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return Upload{}, err
+	}
+	js, err := json.Marshal(u)
+	if err != nil {
+		return Upload{}, err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, uploadInfoName), js, 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		return Upload{}, err
+	}
+	return u, nil
+}
+
+// PutChunk stores chunk number n of upload id, replacing a chunk with the
+// same number received before. It fails once the chunks of the upload
+// would no longer fit into the quota of the project.
+func (s *Storage) PutChunk(id string, n int, r io.Reader) error {
+	if n < 1 {
+		return fmt.Errorf("invalid chunk number %d", n)
+	}
+	defer s.uploadLocks.RLock(id)()
+	dir, err := s.stagingDir(id)
+	if err != nil {
+		return err
+	}
+	u, err := readUpload(dir)
+	if err != nil {
+		return err
+	}
+	var staged int64
+	for _, c := range u.Chunks {
+		if c.Number != n {
+			staged += c.Size
+		}
+	}
+	f, err := s.Resolve(u.Path)
+	if err != nil {
+		return err
+	}
+	info, err := s.backend.Stat(&f)
+	existed := err == nil
+	if err != nil && !errors.Is(err, file.ErrNotFound) {
+		return err
+	}
+	r = s.usage.limit(f.Path, r, staged, info.Size, existed)
+	tmp, err := ioutil.TempFile(dir, "chunk-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, strconv.Itoa(n)))
+}
+
+// UploadStatus describes upload id together with the chunks received so
+// far, which lets clients resume after a failure.
+func (s *Storage) UploadStatus(id string) (Upload, error) {
+	defer s.uploadLocks.RLock(id)()
+	dir, err := s.stagingDir(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	return readUpload(dir)
+}
+
+func readUpload(dir string) (Upload, error) {
+	var u Upload
+	js, err := ioutil.ReadFile(filepath.Join(dir, uploadInfoName))
+	if err != nil {
+		return u, err
+	}
+	err = json.Unmarshal(js, &u)
+	if err != nil {
+		return u, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return u, err
+	}
+	u.Chunks = []Chunk{}
+	for _, fi := range fis {
+		n, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		u.Chunks = append(u.Chunks, Chunk{Number: n, Size: fi.Size()})
+	}
+	sort.Slice(u.Chunks, func(i, j int) bool {
+		return u.Chunks[i].Number < u.Chunks[j].Number
+	})
+	var offset int64
+	for i := range u.Chunks {
+		u.Chunks[i].Offset = offset
+		offset += u.Chunks[i].Size
+	}
+	return u, nil
+}
+
+// CompleteUpload assembles the chunks of upload id and saves them as one
+// file if p is satisfied. The chunks must be numbered 1 to n without gaps.
+// When checksum is not empty the assembled content must have this SHA-256.
+// The staging directory is removed once the file is saved.
+func (s *Storage) CompleteUpload(id, checksum string, p Precondition) error {
+	defer s.uploadLocks.Lock(id)()
+	dir, err := s.stagingDir(id)
+	if err != nil {
+		return err
+	}
+	u, err := readUpload(dir)
+	if err != nil {
+		return err
+	}
+	var rs []io.Reader
+	for i, c := range u.Chunks {
+		if c.Number != i+1 {
+			return fmt.Errorf("%s: %w: chunk %d is missing", id, ErrIncompleteUpload, i+1)
+		}
+		fl, err := os.Open(filepath.Join(dir, strconv.Itoa(c.Number)))
+		if err != nil {
+			return err
+		}
+		defer fl.Close()
+		rs = append(rs, fl)
+	}
+	var r io.Reader = io.MultiReader(rs...)
+	if checksum != "" {
+		r = file.VerifyingReader(r, checksum)
+	}
+	err = s.SaveIf(u.Path, r, p)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// AbortUpload discards upload id and its chunks.
+func (s *Storage) AbortUpload(id string) error {
+	defer s.uploadLocks.Lock(id)()
+	dir, err := s.stagingDir(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// ExpireUploads discards the uploads that have not received a chunk for
+// longer than the upload TTL and returns their number.
+func (s *Storage) ExpireUploads() (int, error) {
+	if s.Config.UploadTTL <= 0 {
+		return 0, nil
+	}
+	fis, err := ioutil.ReadDir(s.uploadDir())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fi := range fis {
+		expired, err := s.expireUpload(fi.Name())
+		if err != nil {
+			return n, err
+		}
+		if expired {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *Storage) expireUpload(id string) (bool, error) {
+	defer s.uploadLocks.Lock(id)()
+	dir, err := s.stagingDir(id)
+	if errors.Is(err, ErrUploadNotFound) {
+		// Completed or aborted in the meantime, or not an upload.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	deadline := time.Now().Add(-s.Config.UploadTTL)
+	for _, fi := range fis {
+		if fi.ModTime().After(deadline) {
+			return false, nil
+		}
+	}
+	return true, os.RemoveAll(dir)
+}
+
+// RunExpireUploads calls ExpireUploads every interval until stop is closed.
+func (s *Storage) RunExpireUploads(interval time.Duration, stop <-chan struct{}) {
+	for {
+		n, err := s.ExpireUploads()
+		if err != nil {
+			log.Printf("Expiring uploads failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Discarded %d expired uploads", n)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
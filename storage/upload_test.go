@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/memory"
+)
+
+func TestResumableUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewStorageWithBackend(StorageConfig{UploadDir: dir}, memory.NewBackend())
+	saves := 0
+	s.On(Save, func(e Event) error {
+		saves++
+		return nil
+	})
+
+	u, err := s.InitiateUpload("model/out.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []string{"first,", "second,", "third"}
+	for _, n := range []int{3, 1} {
+		err = s.PutChunk(u.ID, n, strings.NewReader(chunks[n-1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.CompleteUpload(u.ID, "", Precondition{})
+	if !errors.Is(err, ErrIncompleteUpload) {
+		t.Errorf("CompleteUpload with a missing chunk returned %v", err)
+	}
+
+	st, err := s.UploadStatus(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Chunks) != 2 || st.Chunks[0].Number != 1 || st.Chunks[1].Number != 3 || st.Chunks[1].Offset != 6 {
+		t.Errorf("UploadStatus returned %+v", st.Chunks)
+	}
+
+	err = s.PutChunk(u.ID, 2, strings.NewReader(chunks[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join(chunks, "")
+	err = s.CompleteUpload(u.ID, strings.Repeat("0", 64), Precondition{})
+	if !errors.Is(err, file.ErrChecksumMismatch) {
+		t.Errorf("CompleteUpload with a wrong checksum returned %v", err)
+	}
+	if saves != 0 {
+		t.Fatalf("%d Save events before the upload was complete", saves)
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	err = s.CompleteUpload(u.ID, hex.EncodeToString(sum[:]), Precondition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saves != 1 {
+		t.Errorf("%d Save events after the upload was completed", saves)
+	}
+	buf := &bytes.Buffer{}
+	err = s.Read("model/out.nc", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != content {
+		t.Errorf("assembled file is %q", buf.String())
+	}
+	_, err = s.UploadStatus(u.ID)
+	if !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("completed upload is still staged: %v", err)
+	}
+}
+
+func TestAbortUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewStorageWithBackend(StorageConfig{UploadDir: dir}, memory.NewBackend())
+
+	u, err := s.InitiateUpload("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutChunk(u.ID, 1, strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AbortUpload(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutChunk(u.ID, 2, strings.NewReader("data"))
+	if !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("PutChunk after abort returned %v", err)
+	}
+	err = s.PutChunk("../../etc", 1, strings.NewReader("data"))
+	if !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("PutChunk with an invalid id returned %v", err)
+	}
+}
+
+func TestUploadStagingAndExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStorage(StorageConfig{
+		Dir:       dir,
+		UploadTTL: time.Hour,
+		Quotas:    map[string]Quota{"p": {Bytes: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.InitiateUpload("p/a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging := filepath.Join(dir, uploadsDir, u.ID)
+	if _, err := os.Stat(staging); err != nil {
+		t.Fatalf("upload is not staged within the directory: %v", err)
+	}
+	err = s.PutChunk(u.ID, 1, strings.NewReader("123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutChunk(u.ID, 2, strings.NewReader("123456"))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("PutChunk beyond the quota returned %v", err)
+	}
+	err = s.PutChunk(u.ID, 1, strings.NewReader("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutChunk(u.ID, 2, strings.NewReader("123456"))
+	if err != nil {
+		t.Errorf("PutChunk within the quota returned %v", err)
+	}
+	infos, _, err := s.List("", "", 0)
+	if err != nil || len(infos) != 0 {
+		t.Errorf("List shows staged chunks: %+v, %v", infos, err)
+	}
+
+	n, err := s.ExpireUploads()
+	if err != nil || n != 0 {
+		t.Errorf("ExpireUploads of a fresh upload returned %d, %v", n, err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	fis, _ := ioutil.ReadDir(staging)
+	for _, fi := range fis {
+		os.Chtimes(filepath.Join(staging, fi.Name()), old, old)
+	}
+	n, err = s.ExpireUploads()
+	if err != nil || n != 1 {
+		t.Errorf("ExpireUploads of a stale upload returned %d, %v", n, err)
+	}
+	_, err = s.UploadStatus(u.ID)
+	if !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("UploadStatus of expired upload returned %v", err)
+	}
+}
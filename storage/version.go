@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/visheratin/storage/file"
+)
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// Versions are kept in the backend under .versions/<path>/<id>, delete
+// markers as empty files with the deletedSuffix.
+const deletedSuffix = ".deleted"
+
+type Version struct {
+	ID       string    `json:"id"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Checksum string    `json:"checksum,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"`
+	Current  bool      `json:"current,omitempty"`
+}
+
+// versionID derives the identifier of a version from when it was written,
+// so that identifiers sort chronologically.
+func versionID(info file.Info) string {
+	id := info.ModTime.UTC().Format("20060102T150405.000000000Z")
+	if len(info.Checksum) >= 12 {
+		id += "-" + info.Checksum[:12]
+	}
+	return id
+}
+
+func versionsPrefix(path string) string {
+	return versionsDir + "/" + path + "/"
+}
+
+func (s *Storage) versionFile(path, id string) (file.File, error) {
+	return s.backend.Resolve(versionsPrefix(path) + id)
+}
+
+func (s *Storage) currentVersion(f *file.File) (string, error) {
+	info, err := s.backend.Stat(f)
+	if err != nil {
+		return "", err
+	}
+	return versionID(info), nil
+}
+
+// archive copies the current content of f into the version store. It is a
+// no-op when there is no current content.
+func (s *Storage) archive(f *file.File) error {
+	info, err := s.backend.Stat(f)
+	if errors.Is(err, file.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	vf, err := s.versionFile(f.Path, versionID(info))
+	if err != nil {
+		return err
+	}
+	err = s.copyFile(f, &vf)
+	if err != nil {
+		return err
+	}
+	s.usage.retain(f.Path, info.Size)
+	return nil
+}
+
+func (s *Storage) markDeleted(f *file.File) (string, error) {
+	id := time.Now().UTC().Format("20060102T150405.000000000Z") + deletedSuffix
+	vf, err := s.versionFile(f.Path, id)
+	if err != nil {
+		return "", err
+	}
+	return id, s.backend.Save(&vf, strings.NewReader(""))
+}
+
+// Versions lists all versions of path, oldest first. The current content,
+// if any, is the last entry.
+func (s *Storage) Versions(path string) ([]Version, error) {
+	f, err := s.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	defer s.locks.RLock(f.Path)()
+
+	prefix := versionsPrefix(f.Path)
+	infos, err := s.backend.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var vs []Version
+	for _, info := range infos {
+		id := strings.TrimPrefix(info.Path, prefix)
+		if strings.Contains(id, "/") {
+			// Versions of a file further down the tree.
+			continue
+		}
+		vs = append(vs, Version{
+			ID:       id,
+			Size:     info.Size,
+			ModTime:  info.ModTime,
+			Checksum: info.Checksum,
+			Deleted:  strings.HasSuffix(id, deletedSuffix),
+		})
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		return vs[i].ID < vs[j].ID
+	})
+
+	info, err := s.backend.Stat(&f)
+	if err == nil {
+		vs = append(vs, Version{
+			ID:       versionID(info),
+			Size:     info.Size,
+			ModTime:  info.ModTime,
+			Checksum: info.Checksum,
+			Current:  true,
+		})
+	} else if !errors.Is(err, file.ErrNotFound) {
+		return nil, err
+	}
+	if len(vs) == 0 {
+		return nil, fmt.Errorf("%s: %w", f.Path, file.ErrNotFound)
+	}
+	return vs, nil
+}
+
+// versionSource returns the backend file holding version id of f.
+func (s *Storage) versionSource(f *file.File, id string) (file.File, error) {
+	if strings.HasSuffix(id, deletedSuffix) {
+		return file.File{}, fmt.Errorf("%s@%s: %w", f.Path, id, ErrVersionNotFound)
+	}
+	cur, err := s.currentVersion(f)
+	if err == nil && cur == id {
+		return *f, nil
+	}
+	vf, err := s.versionFile(f.Path, id)
+	if err != nil {
+		return file.File{}, err
+	}
+	_, err = s.backend.Stat(&vf)
+	if errors.Is(err, file.ErrNotFound) {
+		return file.File{}, fmt.Errorf("%s@%s: %w", f.Path, id, ErrVersionNotFound)
+	}
+	if err != nil {
+		return file.File{}, err
+	}
+	return vf, nil
+}
+
+// ReadVersion writes the content of version id of path.
+func (s *Storage) ReadVersion(path, id string, w io.Writer) error {
+	return s.apply(path, Read, func(e *Event) error {
+		src, err := s.versionSource(e.File, id)
+		if err != nil {
+			return err
+		}
+		e.Version = id
+		return s.backend.Read(&src, w)
+	})
+}
+
+// Restore makes version id the current content of path. The content it
+// replaces is kept as a version, so a restore can itself be undone.
+func (s *Storage) Restore(path, id string) error {
+	return s.apply(path, Save, func(e *Event) error {
+		src, err := s.versionSource(e.File, id)
+		if err != nil {
+			return err
+		}
+		if src.Path == e.File.Path {
+			// Already current.
+			e.Version = id
+			return nil
+		}
+		err = s.archive(e.File)
+		if err != nil {
+			return err
+		}
+		err = s.copyFile(&src, e.File)
+		if err != nil {
+			return err
+		}
+		e.Version, err = s.currentVersion(e.File)
+		return err
+	})
+}
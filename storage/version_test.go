@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/visheratin/storage/memory"
+)
+
+func TestVersioning(t *testing.T) {
+	s := NewStorageWithBackend(StorageConfig{Versioning: true}, memory.NewBackend())
+	var events []Event
+	s.On(Save, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	s.On(Delete, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+
+	for _, c := range []string{"v1", "v2", "v3"} {
+		err := s.Save("a.nc", strings.NewReader(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Version identifiers are derived from the modification time.
+		time.Sleep(time.Millisecond)
+	}
+	err := s.Delete("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := s.Versions("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 4 || !vs[3].Deleted {
+		t.Fatalf("Versions returned %+v", vs)
+	}
+	if events[0].Version != vs[0].ID || events[3].Version != vs[3].ID {
+		t.Errorf("event versions %+v do not match %+v", events, vs)
+	}
+
+	buf := new(bytes.Buffer)
+	err = s.ReadVersion("a.nc", vs[1].ID, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "v2" {
+		t.Errorf("ReadVersion returned %q", buf.String())
+	}
+	err = s.ReadVersion("a.nc", vs[3].ID, buf)
+	if !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("ReadVersion of delete marker returned %v", err)
+	}
+
+	err = s.Restore("a.nc", vs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	err = s.Read("a.nc", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "v1" {
+		t.Errorf("restored content is %q", buf.String())
+	}
+	vs, err = s.Versions("a.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 5 || !vs[4].Current {
+		t.Errorf("Versions after restore returned %+v", vs)
+	}
+
+	infos, next, err := s.List("", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Path != "a.nc" || next != "" {
+		t.Errorf("List shows version store: %+v, %q", infos, next)
+	}
+	_, err = s.Resolve(".versions/a.nc/" + vs[0].ID)
+	if err == nil {
+		t.Error("version store is addressable through Resolve")
+	}
+}
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"errors"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/visheratin/storage/file"
+)
+
+type WatchConfig struct {
+	// Interval is the pause between two scans of the whole directory.
+	// Where inotify is available the directories it reports changes in are
+	// scanned right away and the full scans only catch what it misses,
+	// e.g. writes from other hosts over NFS.
+	Interval time.Duration
+	// Debounce is how long a file must stay unchanged before it is
+	// ingested, so that files still being written are not.
+	Debounce time.Duration
+}
+
+type fileState struct {
+	size    int64
+	stored  int64
+	modTime time.Time
+}
+
+func stateOf(info file.Info) fileState {
+	return fileState{info.Size, info.StoredSize, info.ModTime}
+}
+
+func (fs fileState) same(o fileState) bool {
+	return fs.stored == o.stored && fs.modTime.Equal(o.modTime)
+}
+
+type pendingChange struct {
+	state fileState
+	since time.Time
+}
+
+// Watcher ingests files that other processes write into or remove from the
+// directory of the file backend, firing the same Save and Delete events as
+// changes made through Storage.
+type Watcher struct {
+	Config WatchConfig
+
+	storage *Storage
+	fs      *file.FileService
+	mu      sync.Mutex
+	// known holds the state of every file Storage has seen, pending the
+	// changed files that are not stable yet.
+	known   map[string]fileState
+	pending map[string]pendingChange
+	// dirty holds the directories inotify reported changes in, true if
+	// the directories below them changed as well.
+	dirty map[string]bool
+	wake  chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewWatcher(s *Storage, cfg WatchConfig) (*Watcher, error) {
+	fs, ok := s.backend.(*file.FileService)
+	if !ok {
+		return nil, errors.New("Watching needs the file backend")
+	}
+	return &Watcher{
+		Config:  cfg,
+		storage: s,
+		fs:      fs,
+		known:   make(map[string]fileState),
+		pending: make(map[string]pendingChange),
+		dirty:   make(map[string]bool),
+	}, nil
+}
+
+// Start takes the files in the directory as known and watches for changes
+// in the background until Stop is called.
+func (w *Watcher) Start() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.storage.mu.Lock()
+	w.storage.watcher = w
+	w.storage.mu.Unlock()
+	infos, err := w.fs.List("")
+	if err != nil {
+		w.detach()
+		return err
+	}
+	for _, info := range infos {
+		if !isInternal(info.Path) {
+			w.known[info.Path] = stateOf(info)
+		}
+	}
+
+	w.wake = make(chan struct{}, 1)
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	err = notify(w.fs.Dir, w.changed, w.stop)
+	if err != nil {
+		log.Printf("Watching %s by polling only: %v", w.fs.Dir, err)
+	}
+	go func() {
+		defer close(w.done)
+		for {
+			var dirs map[string]bool
+			select {
+			case <-w.stop:
+				return
+			case <-w.wake:
+				dirs = w.takeDirty()
+			case <-time.After(w.Config.Interval):
+				dirs = map[string]bool{"": true}
+			}
+			// Files that are still changing are looked at again once
+			// they could have settled.
+			for w.scan(dirs) {
+				select {
+				case <-w.stop:
+					return
+				case <-time.After(w.Config.Debounce):
+				}
+				dirs = w.takeDirty()
+			}
+		}
+	}()
+	return nil
+}
+
+// changed records a change in dir reported by inotify and wakes the
+// watcher.
+func (w *Watcher) changed(dir string, recursive bool) {
+	w.mu.Lock()
+	w.dirty[dir] = w.dirty[dir] || recursive
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takeDirty returns the directories to scan, those with reported changes
+// and those with files still pending.
+func (w *Watcher) takeDirty() map[string]bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dirs := w.dirty
+	w.dirty = make(map[string]bool)
+	for p := range w.pending {
+		if _, ok := dirs[parentDir(p)]; !ok {
+			dirs[parentDir(p)] = false
+		}
+	}
+	return dirs
+}
+
+// parentDir returns the directory of path, empty for the root.
+func parentDir(p string) string {
+	d := path.Dir(p)
+	if d == "." {
+		return ""
+	}
+	return d
+}
+
+// inScope reports whether p is a file in one of dirs.
+func inScope(dirs map[string]bool, p string) bool {
+	d := parentDir(p)
+	for {
+		if recursive, ok := dirs[d]; ok && (recursive || d == parentDir(p)) {
+			return true
+		}
+		if d == "" {
+			return false
+		}
+		d = parentDir(d)
+	}
+}
+
+func (w *Watcher) Stop() {
+	close(w.stop)
+	<-w.done
+	w.detach()
+}
+
+func (w *Watcher) detach() {
+	w.storage.mu.Lock()
+	w.storage.watcher = nil
+	w.storage.mu.Unlock()
+}
+
+func (w *Watcher) hasPending() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending) > 0
+}
+
+// Scan compares the directory with the known files and ingests the files
+// that have been stable for the debounce time or are gone. It reports
+// whether changes are still pending.
+func (w *Watcher) Scan() bool {
+	return w.scan(map[string]bool{"": true})
+}
+
+// scan is Scan limited to the files in dirs, with the directories below
+// them for the ones set to true.
+func (w *Watcher) scan(dirs map[string]bool) bool {
+	var infos []file.Info
+	for dir, recursive := range dirs {
+		var dinfos []file.Info
+		var err error
+		switch {
+		case recursive && dir == "":
+			dinfos, err = w.fs.List("")
+		case recursive:
+			dinfos, err = w.fs.List(dir + "/")
+		default:
+			dinfos, err = w.fs.ListDir(dir)
+		}
+		if err != nil {
+			log.Printf("Failed to scan %s: %v", path.Join(w.fs.Dir, dir), err)
+			return false
+		}
+		infos = append(infos, dinfos...)
+	}
+	now := time.Now()
+	seen := make(map[string]bool)
+	var changed []string
+	w.mu.Lock()
+	for _, info := range infos {
+		if isInternal(info.Path) || seen[info.Path] {
+			continue
+		}
+		seen[info.Path] = true
+		st := stateOf(info)
+		if k, ok := w.known[info.Path]; ok && k.same(st) {
+			delete(w.pending, info.Path)
+			continue
+		}
+		p, ok := w.pending[info.Path]
+		if !ok || !p.state.same(st) {
+			w.pending[info.Path] = pendingChange{st, now}
+			continue
+		}
+		if now.Sub(p.since) >= w.Config.Debounce {
+			changed = append(changed, info.Path)
+		}
+	}
+	for p := range w.known {
+		if !seen[p] && inScope(dirs, p) {
+			changed = append(changed, p)
+		}
+	}
+	for p := range w.pending {
+		if !seen[p] && inScope(dirs, p) {
+			delete(w.pending, p)
+		}
+	}
+	w.mu.Unlock()
+
+	sort.Strings(changed)
+	for _, p := range changed {
+		err := w.ingest(p)
+		if err != nil {
+			log.Printf("Failed to ingest %s: %v", p, err)
+		}
+	}
+	return w.hasPending()
+}
+
+// ingest fires the event for an outside change of path. It holds the
+// path's lock, so changes made through Storage in the meantime are seen
+// and not reported twice.
+func (w *Watcher) ingest(path string) error {
+	s := w.storage
+	f, err := s.Resolve(path)
+	if err != nil {
+		return err
+	}
+	defer s.locks.Lock(f.Path)()
+	info, err := w.fs.Stat(&f)
+	w.mu.Lock()
+	k, existed := w.known[f.Path]
+	delete(w.pending, f.Path)
+	w.mu.Unlock()
+
+	e := Event{File: &f, Existed: existed, PrevSize: k.size}
+	switch {
+	case errors.Is(err, file.ErrNotFound):
+		if !existed {
+			return nil
+		}
+		e.Type = Delete
+		return s.trigger(e)
+	case err != nil:
+		return err
+	case existed && k.same(stateOf(info)):
+		return nil
+	case info.Checksum != "":
+		// Saved through FileService, by Storage before this watcher
+		// knew about it.
+		w.mu.Lock()
+		w.known[f.Path] = stateOf(info)
+		w.mu.Unlock()
+		return nil
+	}
+	info, err = w.fs.Adopt(&f)
+	if err != nil {
+		return err
+	}
+	e.Type = Save
+	e.Size, e.Checksum, e.ETag = info.Size, info.Checksum, ETag(info)
+	return s.triggerLocal(e)
+}
+
+// update keeps the known files in line with the events fired by Storage.
+func (w *Watcher) update(e Event) {
+	var info file.Info
+	var err error
+	if e.Type == Save || e.Type == Copy || e.Type == Move {
+		info, err = w.fs.Stat(e.File)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch e.Type {
+	case Save, Copy, Move:
+		if err == nil {
+			w.known[e.File.Path] = stateOf(info)
+		}
+	case Delete:
+		delete(w.known, e.File.Path)
+	}
+	if e.Type == Move {
+		delete(w.known, e.Source.Path)
+	}
+}
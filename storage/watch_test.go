@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewStorage(StorageConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Save("a.nc", strings.NewReader("existing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event, 10)
+	for _, typ := range []EventType{Save, Delete} {
+		s.On(typ, func(e Event) error {
+			events <- e
+			return nil
+		})
+	}
+	next := func() Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event fired")
+		}
+		return Event{}
+	}
+
+	w, err := NewWatcher(s, WatchConfig{Interval: 20 * time.Millisecond, Debounce: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	os.MkdirAll(filepath.Join(dir, "run1"), os.ModePerm)
+	err = ioutil.WriteFile(filepath.Join(dir, "run1", "out.nc"), []byte("model output"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := next()
+	if e.Type != Save || e.File.Path != "run1/out.nc" || e.Size != 12 || e.Existed {
+		t.Fatalf("event for a new file is %+v", e)
+	}
+	info, err := s.Stat("run1/out.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Checksum == "" {
+		t.Error("ingested file has no checksum")
+	}
+
+	// Saves through Storage are not reported again.
+	err = s.Save("b.nc", strings.NewReader("uploaded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e = next(); e.File.Path != "b.nc" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	err = os.Remove(filepath.Join(dir, "a.nc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = next()
+	if e.Type != Delete || e.File.Path != "a.nc" || !e.Existed || e.PrevSize != 8 {
+		t.Fatalf("event for a removed file is %+v", e)
+	}
+	if u := s.Usage()[""]; u.Files != 1 || u.Bytes != 8 {
+		t.Errorf("usage is %+v", u)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case e = <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestWatcherScansChangedDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewStorage(StorageConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []string
+	s.On(Save, func(e Event) error {
+		saved = append(saved, e.File.Path)
+		return nil
+	})
+	w, err := NewWatcher(s, WatchConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a/x.nc", "a/sub/y.nc", "b/z.nc"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), os.ModePerm)
+		err = ioutil.WriteFile(filepath.Join(dir, p), []byte(p), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first scan sees the changes, the second ingests them.
+	for _, dirs := range []map[string]bool{{"a": false}, {"a": false}} {
+		w.scan(dirs)
+	}
+	if strings.Join(saved, ",") != "a/x.nc" {
+		t.Errorf("scan of a ingested %v", saved)
+	}
+	saved = nil
+	for _, dirs := range []map[string]bool{{"a": true}, {"a": true}} {
+		w.scan(dirs)
+	}
+	if strings.Join(saved, ",") != "a/sub/y.nc" {
+		t.Errorf("scan of a and below ingested %v", saved)
+	}
+	saved = nil
+	w.Scan()
+	w.Scan()
+	if strings.Join(saved, ",") != "b/z.nc" {
+		t.Errorf("full scan ingested %v", saved)
+	}
+}
+
+func TestWatcherKeepsTouchedEncryptedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := filepath.Join(dir, "keys")
+	err = ioutil.WriteFile(keys, []byte("k1 "+strings.Repeat("11", 32)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := filepath.Join(dir, "data")
+	s, err := NewStorage(StorageConfig{Dir: data, KeyFile: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Save("a.nc", strings.NewReader("embargoed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWatcher(s, WatchConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(filepath.Join(data, "a.nc"), later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Scan()
+	w.Scan()
+
+	buf := new(strings.Builder)
+	err = s.Read("a.nc", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "embargoed" {
+		t.Errorf("Read after touch returned %q", buf.String())
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/visheratin/storage/file"
+	"github.com/visheratin/storage/storage"
+)
+
+// Resumable uploads: POST /uploads?path=<path> returns the id of a new
+// upload, PUT /uploads/<id>/<n> stores chunk n, GET /uploads/<id> lists the
+// received chunks, POST /uploads/<id> assembles the file and DELETE
+// /uploads/<id> aborts the upload.
+
+func writeUpload(w http.ResponseWriter, u storage.Upload, status int) {
+	js, err := json.Marshal(u)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+func initiateUploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "Missing path", http.StatusBadRequest)
+		return
+	}
+	u, err := s.InitiateUpload(path)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Location", "/uploads/"+u.ID)
+	writeUpload(w, u, http.StatusCreated)
+}
+
+func uploadStatusHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	u, err := s.UploadStatus(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	writeUpload(w, u, http.StatusOK)
+}
+
+func chunkHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+	n, err := strconv.Atoi(ps.ByName("chunk"))
+	if err != nil || n < 1 {
+		http.Error(w, "Invalid chunk number", http.StatusBadRequest)
+		return
+	}
+	body := io.Reader(r.Body)
+	sum, err := requestDigest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sum != "" {
+		body = file.VerifyingReader(body, sum)
+	}
+	err = s.PutChunk(ps.ByName("id"), n, body)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// completeUploadHandler takes the checksum of the whole file from a
+// Repr-Digest header and preconditions from If-Match and If-None-Match.
+func completeUploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	p := storage.Precondition{
+		IfMatch:     etagList(r.Header.Get("If-Match")),
+		IfNoneMatch: etagList(r.Header.Get("If-None-Match")),
+	}
+	sum, err := reprDigest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.CompleteUpload(ps.ByName("id"), sum, p)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func abortUploadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := s.AbortUpload(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err, http.StatusInternalServerError))
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type fileResult struct {
+	storage.UnpackResult
+	Status int `json:"status"`
+}
+
+// writeResults reports the outcome of a batch upload per file. The
+// response is 207 Multi-Status when some of the files failed.
+func writeResults(w http.ResponseWriter, res []storage.UnpackResult) {
+	frs := make([]fileResult, len(res))
+	status := http.StatusOK
+	for i, r := range res {
+		frs[i] = fileResult{r, http.StatusCreated}
+		if r.Err != nil {
+			frs[i].Status = errorStatus(r.Err, http.StatusInternalServerError)
+			status = http.StatusMultiStatus
+		}
+	}
+
+	js, err := json.Marshal(frs)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// formUploadHandler saves every file of a multipart form under dir, using
+// the file names the client sent. Other form fields are ignored.
+func formUploadHandler(w http.ResponseWriter, r *http.Request, dir string) {
+	defer r.Body.Close()
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := []storage.UnpackResult{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := part.FileName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+		res = append(res, s.SaveEntry(dir, name, part))
+		part.Close()
+	}
+	writeResults(w, res)
+}
+
+// unpackHandler saves the files of a tar, tar.gz or zip archive sent as the
+// request body under the prefix.
+func unpackHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+	res, err := s.Unpack(ps.ByName("path"), r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v, %d files were saved", err, len(res)), http.StatusBadRequest)
+		return
+	}
+	if res == nil {
+		res = []storage.UnpackResult{}
+	}
+	writeResults(w, res)
+}